@@ -0,0 +1,81 @@
+// Package api
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/mnhkahn/gogogo/app"
+	"github.com/mnhkahn/peanut/service"
+)
+
+// AliasResponse is the body of an alias request.
+type AliasResponse struct {
+	Alias string `json:"alias"`
+	Index string `json:"index,omitempty"`
+}
+
+// AliasesHandler serves aliases:
+//
+//	GET    /aliases                     list aliases
+//	GET    /aliases/{alias}             get the index of an alias
+//	PUT    /aliases/{alias}?index=name  point alias to an index, swapping it if it exists
+//	DELETE /aliases/{alias}             remove an alias
+func (a *Api) AliasesHandler(c *app.Context) error {
+	alias := strings.Trim(strings.TrimPrefix(c.Request.URL.Path, "/aliases"), "/")
+
+	if alias == "" {
+		if c.Request.Method != http.MethodGet {
+			return writeError(c, errMethodNotAllowed)
+		}
+		return writeJSON(c, http.StatusOK, a.reg.Aliases())
+	}
+
+	switch c.Request.Method {
+	case http.MethodGet:
+		name, ok := a.reg.Aliases()[alias]
+		if !ok {
+			return writeError(c, service.ErrAliasNotFound)
+		}
+		return writeJSON(c, http.StatusOK, &AliasResponse{Alias: alias, Index: name})
+	case http.MethodPut, http.MethodPost:
+		name := c.Query().Get("index")
+		if name == "" {
+			return writeError(c, badRequest(errors.New("index is required")))
+		}
+		err := a.reg.SetAlias(alias, name)
+		if err != nil {
+			return writeError(c, err)
+		}
+		return writeJSON(c, http.StatusOK, &AliasResponse{Alias: alias, Index: name})
+	case http.MethodDelete:
+		err := a.reg.RemoveAlias(alias)
+		if err != nil {
+			return writeError(c, err)
+		}
+		return writeJSON(c, http.StatusOK, &AliasResponse{Alias: alias})
+	}
+	return writeError(c, errMethodNotAllowed)
+}
+
+// JobsHandler serves background jobs:
+//
+//	GET /jobs       list jobs, the latest first
+//	GET /jobs/{id}  get a job
+func (a *Api) JobsHandler(c *app.Context) error {
+	if c.Request.Method != http.MethodGet {
+		return writeError(c, errMethodNotAllowed)
+	}
+
+	id := strings.Trim(strings.TrimPrefix(c.Request.URL.Path, "/jobs"), "/")
+	if id == "" {
+		return writeJSON(c, http.StatusOK, a.reg.Jobs())
+	}
+
+	job, err := a.reg.Job(id)
+	if err != nil {
+		return writeError(c, err)
+	}
+	return writeJSON(c, http.StatusOK, job)
+}
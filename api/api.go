@@ -1,13 +1,34 @@
 // Package api
 package api
 
+import (
+	"net/http"
+
+	"github.com/mnhkahn/peanut/service"
+)
+
+// Api is the http handler of peanut, it serves the indexes of a registry.
+type Api struct {
+	reg *service.Registry
+	mux *http.ServeMux
+}
+
+// InitApi is kept for the callers of the old entry point, the routes of an Api are
+// registered by NewApi.
 func InitApi() error {
-	var err error
+	return InitRouter()
+}
 
-	err = InitRouter()
-	if err != nil {
-		return err
-	}
+// NewApi returns the http handler serving reg.
+func NewApi(reg *service.Registry) *Api {
+	a := new(Api)
+	a.reg = reg
+	a.mux = http.NewServeMux()
+	a.initRouter()
+	return a
+}
 
-	return nil
+// ServeHTTP ...
+func (a *Api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
 }
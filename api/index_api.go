@@ -0,0 +1,715 @@
+// Package api
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mnhkahn/gogogo/app"
+	"github.com/mnhkahn/gogogo/logger"
+	"github.com/mnhkahn/peanut/index"
+	"github.com/mnhkahn/peanut/service"
+)
+
+var (
+	errBadRequest       = errors.New("bad request")
+	errMethodNotAllowed = errors.New("method not allowed")
+	errDocumentNotFound = index.ErrDocumentNotFound
+)
+
+// SearchResponse is the body of a search request.
+type SearchResponse struct {
+	Total     int               `json:"total"`
+	Documents []*index.Document `json:"documents"`
+	// Next is the search_after cursor of the next page.
+	Next string `json:"next,omitempty"`
+	// Collapsed is the number of hits left out by collapse_duplicates and collapse_by.
+	Collapsed int `json:"collapsed,omitempty"`
+	// Breadcrumbs are the levels of the category paths of the documents by pk.
+	Breadcrumbs map[string][]*index.Breadcrumb `json:"breadcrumbs,omitempty"`
+}
+
+// IndexesHandler serves /indexes and every /indexes/{name}/... path:
+//
+//	GET    /indexes                           list indexes
+//	GET    /indexes/{name}                    bucket stats of an index
+//	PUT    /indexes/{name}                    create an index
+//	DELETE /indexes/{name}                    drop an index
+//	POST   /indexes/{name}/open               open an index
+//	POST   /indexes/{name}/close              close an index
+//	GET    /indexes/{name}/search             search documents
+//	GET    /indexes/{name}/related/{pk}       the documents related to a document, ?size=n, pk can be passed by ?pk= too
+//	GET    /indexes/{name}/duplicates/{pk}    the near duplicates of a document, pk can be passed by ?pk= too
+//	POST   /indexes/{name}/documents          add a document or a list of documents, ?async=true queues them, the near duplicates rejected are listed
+//	POST   /indexes/{name}/refresh            wait until the queued documents are searchable
+//	POST   /indexes/{name}/pv                 add the views of the body {"pk": delta} to the pv of the documents
+//	GET    /indexes/{name}/backup             download a snapshot of an index
+//	POST   /indexes/{name}/restore            replace an index with the snapshot in the body
+//	GET    /indexes/{name}/export             download the documents as NDJSON
+//	POST   /indexes/{name}/import             add the NDJSON documents in the body
+//	GET    /indexes/{name}/check              check the consistency of an index
+//	POST   /indexes/{name}/repair             fix the problems found by check
+//	POST   /indexes/{name}/compact            drop the dead postings and shrink the file
+//	GET    /indexes/{name}/terms/{field}      list the terms of a field, ?prefix=&after=&limit=
+//	GET    /indexes/{name}/categories         the category tree with the number of documents of every category
+//	GET    /indexes/{name}/terms/{field}/{term} get the posting list of a term, term can be passed by ?term= too
+//	GET    /indexes/{name}/documents/{pk}     get a document, pk can be passed by ?pk= too
+//	PATCH  /indexes/{name}/documents/{pk}     update the fields of a document in the body
+//	DELETE /indexes/{name}/documents/{pk}     delete a document
+//	POST   /indexes/{name}/reindex            rebuild an index in the background
+//
+// name can be an alias everywhere but in create and drop.
+func (a *Api) IndexesHandler(c *app.Context) error {
+	name, resource, rest, err := splitIndexPath(c.Request.URL.EscapedPath())
+	if err != nil {
+		return writeError(c, badRequest(err))
+	}
+
+	if name == "" {
+		if c.Request.Method != http.MethodGet {
+			return writeError(c, errMethodNotAllowed)
+		}
+		return a.listIndexes(c)
+	}
+
+	switch resource {
+	case "":
+		return a.indexHandler(c, name)
+	case "open":
+		return a.openIndex(c, name)
+	case "close":
+		return a.closeIndex(c, name)
+	case "search":
+		return a.searchIndex(c, name)
+	case "documents":
+		return a.documentsHandler(c, name, rest)
+	case "related":
+		return a.relatedDocuments(c, name, rest)
+	case "duplicates":
+		return a.nearDuplicates(c, name, rest)
+	case "reindex":
+		return a.reindexIndex(c, name)
+	case "refresh":
+		return a.refreshIndex(c, name)
+	case "pv":
+		return a.incrPV(c, name)
+	case "backup":
+		return a.backupIndex(c, name)
+	case "restore":
+		return a.restoreIndex(c, name)
+	case "export":
+		return a.exportIndex(c, name)
+	case "import":
+		return a.importIndex(c, name)
+	case "check", "repair":
+		return a.checkIndex(c, name, resource == "repair")
+	case "compact":
+		return a.compactIndex(c, name)
+	case "terms":
+		return a.termsHandler(c, name, rest)
+	case "categories":
+		return a.categoryTree(c, name)
+	}
+	return writeJSON(c, http.StatusNotFound, &ErrorResponse{Error: "unknown resource " + resource})
+}
+
+// splitIndexPath splits /indexes/{name}/{resource}/{rest} and unescapes every part.
+func splitIndexPath(p string) (name, resource, rest string, err error) {
+	p = strings.TrimPrefix(p, "/indexes")
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return "", "", "", nil
+	}
+
+	parts := strings.SplitN(p, "/", 3)
+	for i := range parts {
+		parts[i], err = url.PathUnescape(parts[i])
+		if err != nil {
+			return "", "", "", err
+		}
+	}
+	parts = append(parts, "", "")
+	return parts[0], parts[1], parts[2], nil
+}
+
+func (a *Api) listIndexes(c *app.Context) error {
+	infos, err := a.reg.List()
+	if err != nil {
+		return writeError(c, err)
+	}
+	return writeJSON(c, http.StatusOK, infos)
+}
+
+func (a *Api) indexHandler(c *app.Context, name string) error {
+	switch c.Request.Method {
+	case http.MethodGet:
+		idx, err := a.reg.Get(name)
+		if err != nil {
+			return writeError(c, err)
+		}
+		buckets, err := idx.Buckets()
+		if err != nil {
+			return writeError(c, err)
+		}
+		return writeJSON(c, http.StatusOK, buckets)
+	case http.MethodPut, http.MethodPost:
+		_, err := a.reg.Create(name)
+		if err != nil {
+			return writeError(c, err)
+		}
+		return writeJSON(c, http.StatusCreated, &service.IndexInfo{Name: name, Open: true})
+	case http.MethodDelete:
+		err := a.reg.Drop(name)
+		if err != nil {
+			return writeError(c, err)
+		}
+		return writeJSON(c, http.StatusOK, &service.IndexInfo{Name: name})
+	}
+	return writeError(c, errMethodNotAllowed)
+}
+
+func (a *Api) openIndex(c *app.Context, name string) error {
+	if c.Request.Method != http.MethodPost {
+		return writeError(c, errMethodNotAllowed)
+	}
+	_, err := a.reg.Open(name)
+	if err != nil {
+		return writeError(c, err)
+	}
+	return writeJSON(c, http.StatusOK, &service.IndexInfo{Name: name, Open: true})
+}
+
+func (a *Api) closeIndex(c *app.Context, name string) error {
+	if c.Request.Method != http.MethodPost {
+		return writeError(c, errMethodNotAllowed)
+	}
+	err := a.reg.Close(name)
+	if err != nil {
+		return writeError(c, err)
+	}
+	return writeJSON(c, http.StatusOK, &service.IndexInfo{Name: name})
+}
+
+func (a *Api) searchIndex(c *app.Context, name string) error {
+	if c.Request.Method != http.MethodGet {
+		return writeError(c, errMethodNotAllowed)
+	}
+	idx, err := a.reg.Get(name)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	param, err := parseParam(c)
+	if err != nil {
+		return writeError(c, badRequest(err))
+	}
+
+	res, err := idx.Query(param)
+	if err != nil {
+		return writeError(c, err)
+	}
+	if param.Explain || param.GroupSize > 0 {
+		return writeJSON(c, http.StatusOK, res)
+	}
+
+	resp := &SearchResponse{Total: res.Total, Documents: make([]*index.Document, 0, len(res.Hits)), Next: res.Next, Collapsed: res.Collapsed}
+	for _, hit := range res.Hits {
+		resp.Documents = append(resp.Documents, hit.Document)
+		if len(hit.Breadcrumbs) > 0 {
+			if resp.Breadcrumbs == nil {
+				resp.Breadcrumbs = make(map[string][]*index.Breadcrumb)
+			}
+			resp.Breadcrumbs[hit.PK] = hit.Breadcrumbs
+		}
+	}
+	return writeJSON(c, http.StatusOK, resp)
+}
+
+// parseParam reads search param from query string:
+// q, wildcards, pk, tag (any of them), tag_all, tag_none, category (any of them),
+// category_none, offset, size, sort, asc, search_after, collapse_duplicates, collapse_by,
+// group_size, explain, and the function score: decay, decay_origin, decay_offset,
+// decay_scale, decay_factor and pv_factor. The filters can be repeated. With wildcards a
+// word of q can be a wildcard, e.g. json* or *处理, or a regexp between slashes, e.g.
+// /js(on|onp)/.
+func parseParam(c *app.Context) (*index.Param, error) {
+	q := c.Query()
+	param := &index.Param{
+		PKs:            q["pk"],
+		Query:          q.Get("q"),
+		Tags:           q["tag"],
+		TagsAll:        q["tag_all"],
+		TagsNone:       q["tag_none"],
+		Categories:     q["category"],
+		CategoriesNone: q["category_none"],
+	}
+
+	var err error
+	if v := q.Get("wildcards"); v != "" {
+		param.Wildcards, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		param.Offset, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if v := q.Get("size"); v != "" {
+		param.Size, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var asc bool
+	if v := q.Get("asc"); v != "" {
+		asc, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = param.SetSort(q.Get("sort"), asc); err != nil {
+		return nil, err
+	}
+	if v := q.Get("search_after"); v != "" {
+		param.SearchAfter, err = index.ParseCursor(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if param.FunctionScore, err = parseFunctionScore(q); err != nil {
+		return nil, err
+	}
+	if v := q.Get("collapse_duplicates"); v != "" {
+		param.CollapseDuplicates, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	param.CollapseBy = q.Get("collapse_by")
+	if v := q.Get("group_size"); v != "" {
+		param.GroupSize, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if v := q.Get("explain"); v != "" {
+		param.Explain, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return param, nil
+}
+
+// parseFunctionScore reads the function score, it's nil if neither decay nor pv_factor
+// is set. decay_offset and decay_scale are durations, e.g. 168h.
+func parseFunctionScore(q url.Values) (*index.FunctionScore, error) {
+	if q.Get("decay") == "" && q.Get("pv_factor") == "" {
+		return nil, nil
+	}
+
+	var err error
+	f := new(index.FunctionScore)
+	if v := q.Get("pv_factor"); v != "" {
+		if f.PVFactor, err = strconv.ParseFloat(v, 64); err != nil {
+			return nil, err
+		}
+	}
+	if v := q.Get("decay"); v != "" {
+		f.Decay = &index.Decay{Func: v}
+		if v = q.Get("decay_origin"); v != "" {
+			if f.Decay.Origin, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return nil, err
+			}
+		}
+		if v = q.Get("decay_offset"); v != "" {
+			if f.Decay.Offset, err = time.ParseDuration(v); err != nil {
+				return nil, err
+			}
+		}
+		if v = q.Get("decay_scale"); v != "" {
+			if f.Decay.Scale, err = time.ParseDuration(v); err != nil {
+				return nil, err
+			}
+		}
+		if v = q.Get("decay_factor"); v != "" {
+			if f.Decay.Decay, err = strconv.ParseFloat(v, 64); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return f, nil
+}
+
+// relatedDocuments responds the index.Result of index.MoreLikeThis.
+func (a *Api) relatedDocuments(c *app.Context, name, pk string) error {
+	if c.Request.Method != http.MethodGet {
+		return writeError(c, errMethodNotAllowed)
+	}
+	idx, err := a.reg.Get(name)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	if pk == "" {
+		pk = c.Query().Get("pk")
+	}
+	if pk == "" {
+		return writeError(c, badRequest(errors.New("pk is required")))
+	}
+	var size int
+	if v := c.Query().Get("size"); v != "" {
+		if size, err = strconv.Atoi(v); err != nil {
+			return writeError(c, badRequest(err))
+		}
+	}
+
+	res, err := idx.MoreLikeThis(pk, size)
+	if err != nil {
+		return writeError(c, err)
+	}
+	return writeJSON(c, http.StatusOK, res)
+}
+
+// nearDuplicates responds the index.Duplicate list of index.NearDuplicates.
+func (a *Api) nearDuplicates(c *app.Context, name, pk string) error {
+	if c.Request.Method != http.MethodGet {
+		return writeError(c, errMethodNotAllowed)
+	}
+	idx, err := a.reg.Get(name)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	if pk == "" {
+		pk = c.Query().Get("pk")
+	}
+	if pk == "" {
+		return writeError(c, badRequest(errors.New("pk is required")))
+	}
+	dups, err := idx.NearDuplicates(pk)
+	if err != nil {
+		return writeError(c, err)
+	}
+	return writeJSON(c, http.StatusOK, dups)
+}
+
+func (a *Api) documentsHandler(c *app.Context, name, pk string) error {
+	idx, err := a.reg.Get(name)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	if pk == "" {
+		pk = c.Query().Get("pk")
+	}
+
+	switch c.Request.Method {
+	case http.MethodGet:
+		if pk == "" {
+			return writeError(c, badRequest(errors.New("pk is required")))
+		}
+		doc, err := getDocument(idx, pk)
+		if err != nil {
+			return writeError(c, err)
+		}
+		return writeJSON(c, http.StatusOK, doc)
+	case http.MethodDelete:
+		if pk == "" {
+			return writeError(c, badRequest(errors.New("pk is required")))
+		}
+		if err = a.reg.DeleteDocument(name, pk); err != nil {
+			return writeError(c, err)
+		}
+		return writeJSON(c, http.StatusOK, map[string]int{"deleted": 1})
+	case http.MethodPatch:
+		if pk == "" {
+			return writeError(c, badRequest(errors.New("pk is required")))
+		}
+		patch := new(index.DocumentPatch)
+		dec := json.NewDecoder(c.Request.Body)
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(patch); err != nil {
+			return writeError(c, badRequest(err))
+		}
+		doc, err := a.reg.UpdateDocument(name, pk, patch)
+		if err != nil {
+			return writeError(c, err)
+		}
+		return writeJSON(c, http.StatusOK, doc)
+	case http.MethodPost, http.MethodPut:
+		docs, err := decodeDocuments(c.Request)
+		if err != nil {
+			return writeError(c, badRequest(err))
+		}
+		if async, _ := strconv.ParseBool(c.Query().Get("async")); async {
+			if err = a.reg.EnqueueDocuments(name, docs...); err != nil {
+				return writeError(c, err)
+			}
+			return writeJSON(c, http.StatusAccepted, map[string]int{"queued": len(docs)})
+		}
+		err = a.reg.AddDocuments(name, docs...)
+		if rejected, ok := err.(*index.RejectedError); ok {
+			return writeJSON(c, http.StatusOK, map[string]interface{}{
+				"indexed":  len(docs) - len(rejected.Duplicates),
+				"rejected": rejected.Duplicates,
+			})
+		} else if err != nil {
+			return writeError(c, err)
+		}
+		return writeJSON(c, http.StatusOK, map[string]int{"indexed": len(docs)})
+	}
+	return writeError(c, errMethodNotAllowed)
+}
+
+func (a *Api) reindexIndex(c *app.Context, name string) error {
+	if c.Request.Method != http.MethodPost {
+		return writeError(c, errMethodNotAllowed)
+	}
+	job, err := a.reg.Reindex(name)
+	if err != nil {
+		return writeError(c, err)
+	}
+	return writeJSON(c, http.StatusAccepted, job)
+}
+
+func (a *Api) categoryTree(c *app.Context, name string) error {
+	if c.Request.Method != http.MethodGet {
+		return writeError(c, errMethodNotAllowed)
+	}
+	idx, err := a.reg.Get(name)
+	if err != nil {
+		return writeError(c, err)
+	}
+	tree, err := idx.CategoryTree()
+	if err != nil {
+		return writeError(c, err)
+	}
+	return writeJSON(c, http.StatusOK, tree)
+}
+
+func (a *Api) refreshIndex(c *app.Context, name string) error {
+	if c.Request.Method != http.MethodPost {
+		return writeError(c, errMethodNotAllowed)
+	}
+	if err := a.reg.Refresh(name); err != nil {
+		return writeError(c, err)
+	}
+	return writeJSON(c, http.StatusOK, map[string]bool{"refreshed": true})
+}
+
+// incrPV responds the new pv by pk, the pks without a document are left out.
+func (a *Api) incrPV(c *app.Context, name string) error {
+	if c.Request.Method != http.MethodPost {
+		return writeError(c, errMethodNotAllowed)
+	}
+	deltas := make(map[string]int)
+	if err := json.NewDecoder(c.Request.Body).Decode(&deltas); err != nil {
+		return writeError(c, badRequest(err))
+	}
+	pvs, err := a.reg.IncrPVs(name, deltas)
+	if err != nil {
+		return writeError(c, err)
+	}
+	return writeJSON(c, http.StatusOK, pvs)
+}
+
+func (a *Api) backupIndex(c *app.Context, name string) error {
+	if c.Request.Method != http.MethodGet {
+		return writeError(c, errMethodNotAllowed)
+	}
+	if _, err := a.reg.Get(name); err != nil {
+		return writeError(c, err)
+	}
+
+	c.ResponseWriter.Header().Set("Content-Type", "application/octet-stream")
+	c.ResponseWriter.Header().Set("Content-Disposition", `attachment; filename="`+name+`.db"`)
+	// the status is sent with the first byte, a failure later can only abort the body.
+	_, err := a.reg.Backup(name, c.ResponseWriter)
+	if err != nil {
+		logger.Warn("backup index", name, err)
+	}
+	return nil
+}
+
+func (a *Api) restoreIndex(c *app.Context, name string) error {
+	if c.Request.Method != http.MethodPost && c.Request.Method != http.MethodPut {
+		return writeError(c, errMethodNotAllowed)
+	}
+	defer c.Request.Body.Close()
+
+	if err := a.reg.Restore(name, c.Request.Body); err != nil {
+		return writeError(c, err)
+	}
+	return writeJSON(c, http.StatusOK, map[string]bool{"restored": true})
+}
+
+func (a *Api) exportIndex(c *app.Context, name string) error {
+	if c.Request.Method != http.MethodGet {
+		return writeError(c, errMethodNotAllowed)
+	}
+	if _, err := a.reg.Get(name); err != nil {
+		return writeError(c, err)
+	}
+
+	c.ResponseWriter.Header().Set("Content-Type", "application/x-ndjson")
+	c.ResponseWriter.Header().Set("Content-Disposition", `attachment; filename="`+name+`.jsonl"`)
+	_, err := a.reg.Export(name, c.ResponseWriter)
+	if err != nil {
+		logger.Warn("export index", name, err)
+	}
+	return nil
+}
+
+func (a *Api) importIndex(c *app.Context, name string) error {
+	if c.Request.Method != http.MethodPost && c.Request.Method != http.MethodPut {
+		return writeError(c, errMethodNotAllowed)
+	}
+	defer c.Request.Body.Close()
+
+	n, err := a.reg.Import(name, c.Request.Body)
+	if err != nil {
+		// the documents before the bad line are kept.
+		return writeJSON(c, statusCode(err), map[string]interface{}{"imported": n, "error": err.Error()})
+	}
+	return writeJSON(c, http.StatusOK, map[string]int{"imported": n})
+}
+
+func (a *Api) checkIndex(c *app.Context, name string, repair bool) error {
+	if (repair && c.Request.Method != http.MethodPost) || (!repair && c.Request.Method != http.MethodGet) {
+		return writeError(c, errMethodNotAllowed)
+	}
+	idx, err := a.reg.Get(name)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	var report *index.CheckReport
+	if repair {
+		report, err = idx.Repair()
+	} else {
+		report, err = idx.Check()
+	}
+	if err != nil {
+		return writeError(c, err)
+	}
+	return writeJSON(c, http.StatusOK, report)
+}
+
+func (a *Api) compactIndex(c *app.Context, name string) error {
+	if c.Request.Method != http.MethodPost {
+		return writeError(c, errMethodNotAllowed)
+	}
+	idx, err := a.reg.Get(name)
+	if err != nil {
+		return writeError(c, err)
+	}
+	report, err := idx.Compact()
+	if err != nil {
+		return writeError(c, err)
+	}
+	return writeJSON(c, http.StatusOK, report)
+}
+
+// TermsResponse is a page of terms, Next is the after of the next page, empty at the end.
+type TermsResponse struct {
+	Terms []*index.TermStat `json:"terms"`
+	Next  string            `json:"next,omitempty"`
+}
+
+func (a *Api) termsHandler(c *app.Context, name, rest string) error {
+	if c.Request.Method != http.MethodGet {
+		return writeError(c, errMethodNotAllowed)
+	}
+	idx, err := a.reg.Get(name)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	q := c.Query()
+	field, term := rest, q.Get("term")
+	if i := strings.Index(rest, "/"); i >= 0 {
+		field, term = rest[:i], rest[i+1:]
+	}
+	if field == "" {
+		return writeError(c, badRequest(errors.New("field is required")))
+	}
+
+	if term != "" {
+		info, err := idx.Term(field, term)
+		if err != nil {
+			return writeError(c, err)
+		}
+		return writeJSON(c, http.StatusOK, info)
+	}
+
+	limit := 0
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil {
+			return writeError(c, badRequest(err))
+		}
+	}
+	if limit <= 0 {
+		limit = index.DefaultTermsLimit
+	} else if limit > index.MaxTermsLimit {
+		limit = index.MaxTermsLimit
+	}
+	terms, err := idx.Terms(field, q.Get("prefix"), q.Get("after"), limit)
+	if err != nil {
+		return writeError(c, err)
+	}
+	res := &TermsResponse{Terms: terms}
+	if len(terms) == limit {
+		res.Next = terms[len(terms)-1].Term
+	}
+	return writeJSON(c, http.StatusOK, res)
+}
+
+func getDocument(idx *index.Index, pk string) (*index.Document, error) {
+	docIds, err := idx.SearchPks(pk)
+	if err != nil {
+		return nil, err
+	}
+	if len(docIds) == 0 {
+		return nil, errDocumentNotFound
+	}
+	return idx.ToDocuments(docIds[0])[0], nil
+}
+
+// decodeDocuments decodes a json document or a json list of documents from the request body.
+func decodeDocuments(r *http.Request) ([]*index.Document, error) {
+	var raw json.RawMessage
+	err := json.NewDecoder(r.Body).Decode(&raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []*index.Document
+	if trimmed := strings.TrimSpace(string(raw)); strings.HasPrefix(trimmed, "[") {
+		err = json.Unmarshal(raw, &docs)
+	} else {
+		doc := new(index.Document)
+		err = json.Unmarshal(raw, doc)
+		docs = append(docs, doc)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, doc := range docs {
+		// a null of a list is a nil document.
+		if doc == nil || doc.PK == "" {
+			return nil, errors.New("document pk is required")
+		}
+	}
+	return docs, nil
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mnhkahn/peanut/index"
+	"github.com/mnhkahn/peanut/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddDocuments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peanut-api")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := index.DefaultOptions
+	opts.Dictionary = "../index/dictionary.txt"
+	reg, err := service.NewRegistry(dir, opts)
+	assert.Nil(t, err)
+	defer reg.CloseAll()
+	a := NewApi(reg)
+
+	do := func(method, path, body string) int {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w.Code
+	}
+	assert.Equal(t, http.StatusCreated, do(http.MethodPut, "/indexes/blog", ""))
+
+	for _, c := range []struct {
+		body string
+		code int
+	}{
+		{`{"pk": "a", "title": "golang"}`, http.StatusOK},
+		{`[{"pk": "b"}, {"pk": "c"}]`, http.StatusOK},
+		{`null`, http.StatusBadRequest},
+		{`[null]`, http.StatusBadRequest},
+		{`[{"pk": "d"}, null]`, http.StatusBadRequest},
+		{`[{"title": "no pk"}]`, http.StatusBadRequest},
+		{`{"pk": `, http.StatusBadRequest},
+	} {
+		assert.Equal(t, c.code, do(http.MethodPost, "/indexes/blog/documents", c.body), c.body)
+	}
+
+	idx, err := reg.Get("blog")
+	assert.Nil(t, err)
+	docIds, err := idx.SearchPks("a", "b", "c", "d")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(docIds))
+}
@@ -0,0 +1,70 @@
+// Package api
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mnhkahn/gogogo/app"
+	"github.com/mnhkahn/gogogo/logger"
+	"github.com/mnhkahn/peanut/index"
+	"github.com/mnhkahn/peanut/service"
+)
+
+// ErrorResponse is the body of a failed request.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// writeJSON writes v as the json body with status code.
+func writeJSON(c *app.Context, code int, v interface{}) error {
+	c.ResponseWriter.Header().Set("Content-Type", "application/json; charset=utf-8")
+	c.ResponseWriter.WriteHeader(code)
+	return json.NewEncoder(c.ResponseWriter).Encode(v)
+}
+
+// writeError writes err as json with the status code matching the error.
+func writeError(c *app.Context, err error) error {
+	code := statusCode(err)
+	if code >= http.StatusInternalServerError {
+		logger.Warn(c.Request.Method, c.Request.URL.String(), err)
+	}
+	return writeJSON(c, code, &ErrorResponse{Error: err.Error()})
+}
+
+func statusCode(err error) int {
+	switch err {
+	case service.ErrIndexNotFound, service.ErrAliasNotFound, service.ErrJobNotFound, errDocumentNotFound,
+		index.ErrTermNotFound:
+		return http.StatusNotFound
+	case service.ErrIndexExists, service.ErrIndexAliased, service.ErrJobRunning:
+		return http.StatusConflict
+	case service.ErrInvalidName, errBadRequest:
+		return http.StatusBadRequest
+	case errMethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	}
+	if _, ok := err.(badRequestError); ok {
+		return http.StatusBadRequest
+	}
+	switch err.(type) {
+	case *index.SnapshotError, *index.LineError, *index.FieldError, *index.ParamError:
+		return http.StatusBadRequest
+	case *index.DuplicateError, *index.RejectedError:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// badRequestError wraps an error caused by the client.
+type badRequestError struct {
+	err error
+}
+
+func (e badRequestError) Error() string {
+	return e.err.Error()
+}
+
+func badRequest(err error) error {
+	return badRequestError{err}
+}
@@ -1,6 +1,18 @@
 // Package api
 package api
 
+import "github.com/mnhkahn/gogogo/app"
+
+// InitRouter is kept for the callers of the old entry point, see InitApi.
 func InitRouter() error {
 	return nil
 }
+
+func (a *Api) initRouter() {
+	a.mux.Handle("/indexes", app.Got{H: a.IndexesHandler})
+	a.mux.Handle("/indexes/", app.Got{H: a.IndexesHandler})
+	a.mux.Handle("/aliases", app.Got{H: a.AliasesHandler})
+	a.mux.Handle("/aliases/", app.Got{H: a.AliasesHandler})
+	a.mux.Handle("/jobs", app.Got{H: a.JobsHandler})
+	a.mux.Handle("/jobs/", app.Got{H: a.JobsHandler})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/mnhkahn/peanut/index"
+)
+
+func backup(args []string) error {
+	var t target
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	t.flags(fs)
+	out := fs.String("o", "", "snapshot file, stdout if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := t.validate(); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		// write next to the file and rename, a failed backup doesn't overwrite a good one.
+		f, err := os.Create(*out + ".tmp")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		w = f
+	}
+
+	var n int64
+	var err error
+	if t.db != "" {
+		n, err = index.BackupFile(t.db, w)
+	} else {
+		n, err = backupServer(&t, w)
+	}
+	if err != nil {
+		return err
+	}
+
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		if err = f.Sync(); err != nil {
+			return err
+		}
+		if err = f.Close(); err != nil {
+			return err
+		}
+		if err = os.Rename(f.Name(), *out); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "backup %d bytes.\n", n)
+	return nil
+}
+
+func backupServer(t *target, w io.Writer) (int64, error) {
+	resp, err := http.Get(t.url("backup"))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, responseError(resp)
+	}
+	return io.Copy(w, resp.Body)
+}
+
+func restore(args []string) error {
+	var t target
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	t.flags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := t.validate(); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: peanut restore (-server url -index name | -db file) snapshot")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if t.db != "" {
+		return index.Restore(t.db, f)
+	}
+
+	resp, err := http.Post(t.url("restore"), "application/octet-stream", f)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return nil
+}
+
+// responseError returns the error in the body of a failed response.
+func responseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s: %s", resp.Status, body)
+}
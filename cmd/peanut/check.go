@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+
+	"github.com/mnhkahn/peanut/index"
+)
+
+func check(args []string) error {
+	var t target
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	t.flags(fs)
+	repair := fs.Bool("repair", false, "fix the problems found")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := t.validate(); err != nil {
+		return err
+	}
+
+	var report *index.CheckReport
+	var err error
+	if t.db != "" {
+		report, err = checkFile(&t, *repair)
+	} else {
+		report, err = checkServer(&t, *repair)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = printJSON(report); err != nil {
+		return err
+	}
+	if !*repair && !report.OK() {
+		return fmt.Errorf("%d problems found", report.Problems())
+	}
+	return nil
+}
+
+func checkFile(t *target, repair bool) (*index.CheckReport, error) {
+	idx, err := t.open()
+	if err != nil {
+		return nil, err
+	}
+	defer idx.Close()
+
+	if repair {
+		return idx.Repair()
+	}
+	return idx.Check()
+}
+
+func checkServer(t *target, repair bool) (*index.CheckReport, error) {
+	var resp *http.Response
+	var err error
+	if repair {
+		resp, err = http.Post(t.url("repair"), "", nil)
+	} else {
+		resp, err = http.Get(t.url("check"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	report := new(index.CheckReport)
+	return report, json.NewDecoder(resp.Body).Decode(report)
+}
+
+func compact(args []string) error {
+	var t target
+	fs := flag.NewFlagSet("compact", flag.ContinueOnError)
+	t.flags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := t.validate(); err != nil {
+		return err
+	}
+
+	report := new(index.CompactReport)
+	if t.db != "" {
+		idx, err := t.open()
+		if err != nil {
+			return err
+		}
+		report, err = idx.Compact()
+		if cerr := idx.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		resp, err := http.Post(t.url("compact"), "", nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return responseError(resp)
+		}
+		if err = json.NewDecoder(resp.Body).Decode(report); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("removed %d postings, %d terms, %d documents, size %d => %d bytes.\n",
+		report.RemovedPostings, report.DroppedTerms, report.RemovedDocuments, report.SizeBefore, report.SizeAfter)
+	return nil
+}
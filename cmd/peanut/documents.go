@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mnhkahn/peanut/index"
+)
+
+// searchResult is the json output of search.
+type searchResult struct {
+	Total     int               `json:"total"`
+	Documents []*index.Document `json:"documents"`
+	Next      string            `json:"next,omitempty"`
+	Collapsed int               `json:"collapsed,omitempty"`
+}
+
+func search(args []string) error {
+	var t target
+	fs := flag.NewFlagSet("search", flag.ContinueOnError)
+	t.flags(fs)
+	tags := fs.String("tags", "", "any of the tags separated by comma")
+	tagsAll := fs.String("tags-all", "", "all of the tags separated by comma")
+	tagsNone := fs.String("tags-none", "", "none of the tags separated by comma")
+	category := fs.String("category", "", "any of the categories separated by comma")
+	categoryNone := fs.String("category-none", "", "none of the categories separated by comma")
+	offset := fs.Int("offset", 0, "offset of the page")
+	size := fs.Int("size", 10, "size of the page")
+	sortField := fs.String("sort", "", "sort field, pv, pub_date or score, or clauses like pub_date:desc,title:asc:first")
+	asc := fs.Bool("asc", false, "ascending sort")
+	after := fs.String("after", "", "search_after cursor, the next of the previous page")
+	collapse := fs.Bool("collapse-duplicates", false, "keep the first hit of the near duplicates")
+	collapseBy := fs.String("collapse-by", "", "keep the first hit of every category, link_host or tag:prefix")
+	groupSize := fs.Int("group-size", 0, "print the first n hits of every group of -collapse-by")
+	explain := fs.Bool("explain", false, "explain the hits and trace the search")
+	wildcards := fs.Bool("wildcards", false, "read the words of the query with * or ? as wildcards and /.../ as regexps")
+	decay := fs.String("decay", "", "decay of the score by pub_date, gauss or exp")
+	decayOrigin := fs.Int64("decay-origin", 0, "pub_date of the full score, 0 is now")
+	decayOffset := fs.Duration("decay-offset", 0, "distance from the origin that doesn't decay")
+	decayScale := fs.Duration("decay-scale", 0, "distance after the offset where the score is multiplied by -decay-factor")
+	decayFactor := fs.Float64("decay-factor", 0, "decay at the scale, 0.5 if 0")
+	pvFactor := fs.Float64("pv-factor", 0, "popularity factor of the score, log1p(pv-factor * pv)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := t.validate(); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: peanut search [flags] <query>")
+	}
+
+	param := &index.Param{
+		Query:          fs.Arg(0),
+		Wildcards:      *wildcards,
+		Tags:           splitList(*tags),
+		TagsAll:        splitList(*tagsAll),
+		TagsNone:       splitList(*tagsNone),
+		Categories:     splitList(*category),
+		CategoriesNone: splitList(*categoryNone),
+		Offset:         *offset,
+		Size:           *size,
+		Explain:        *explain,
+
+		CollapseDuplicates: *collapse,
+		CollapseBy:         *collapseBy,
+		GroupSize:          *groupSize,
+	}
+	if err := param.SetSort(*sortField, *asc); err != nil {
+		return err
+	}
+	if *decay != "" || *pvFactor != 0 {
+		param.FunctionScore = &index.FunctionScore{PVFactor: *pvFactor}
+		if *decay != "" {
+			param.FunctionScore.Decay = &index.Decay{Func: *decay, Origin: *decayOrigin, Offset: *decayOffset, Scale: *decayScale, Decay: *decayFactor}
+		}
+	}
+	if *after != "" {
+		var err error
+		if param.SearchAfter, err = index.ParseCursor(*after); err != nil {
+			return err
+		}
+	}
+
+	if param.Explain || param.GroupSize > 0 {
+		return querySearch(&t, param)
+	}
+
+	res := new(searchResult)
+	if t.db != "" {
+		idx, err := t.open()
+		if err != nil {
+			return err
+		}
+		defer idx.Close()
+
+		r, err := idx.Query(param)
+		if err != nil {
+			return err
+		}
+		res.Total, res.Next, res.Collapsed = r.Total, r.Next, r.Collapsed
+		res.Documents = make([]*index.Document, 0, len(r.Hits))
+		for _, hit := range r.Hits {
+			res.Documents = append(res.Documents, hit.Document)
+		}
+	} else {
+		if err := getJSON(t.url("search?"+searchQuery(param).Encode()), res); err != nil {
+			return err
+		}
+	}
+	return printJSON(res)
+}
+
+// splitList splits the comma separated s, it's nil if s is empty.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// searchQuery is the query string of the search api for param.
+func searchQuery(param *index.Param) url.Values {
+	q := url.Values{}
+	q.Set("q", param.Query)
+	q.Set("wildcards", strconv.FormatBool(param.Wildcards))
+	q["tag"] = param.Tags
+	q["tag_all"] = param.TagsAll
+	q["tag_none"] = param.TagsNone
+	q["category"] = param.Categories
+	if param.Category != "" {
+		q.Add("category", param.Category)
+	}
+	q["category_none"] = param.CategoriesNone
+	q.Set("offset", strconv.Itoa(param.Offset))
+	q.Set("size", strconv.Itoa(param.Size))
+	if len(param.SortBy) > 0 {
+		clauses := make([]string, 0, len(param.SortBy))
+		for _, c := range param.SortBy {
+			clause := c.Field + ":desc"
+			if c.Asc {
+				clause = c.Field + ":asc"
+			}
+			if c.Missing != "" {
+				clause += ":" + c.Missing
+			}
+			clauses = append(clauses, clause)
+		}
+		q.Set("sort", strings.Join(clauses, ","))
+	} else {
+		q.Set("sort", param.Sort.Field)
+		q.Set("asc", strconv.FormatBool(param.Sort.Asc))
+	}
+	if param.SearchAfter != nil {
+		q.Set("search_after", param.SearchAfter.String())
+	}
+	if f := param.FunctionScore; f != nil {
+		q.Set("pv_factor", strconv.FormatFloat(f.PVFactor, 'g', -1, 64))
+		if d := f.Decay; d != nil {
+			q.Set("decay", d.Func)
+			q.Set("decay_origin", strconv.FormatInt(d.Origin, 10))
+			q.Set("decay_offset", d.Offset.String())
+			q.Set("decay_scale", d.Scale.String())
+			q.Set("decay_factor", strconv.FormatFloat(d.Decay, 'g', -1, 64))
+		}
+	}
+	q.Set("collapse_duplicates", strconv.FormatBool(param.CollapseDuplicates))
+	q.Set("collapse_by", param.CollapseBy)
+	q.Set("group_size", strconv.Itoa(param.GroupSize))
+	q.Set("explain", strconv.FormatBool(param.Explain))
+	return q
+}
+
+// querySearch prints the result of index.Query for param, with the explanations or the
+// groups of param.
+func querySearch(t *target, param *index.Param) error {
+	res := new(index.Result)
+	if t.db != "" {
+		idx, err := t.open()
+		if err != nil {
+			return err
+		}
+		defer idx.Close()
+
+		if res, err = idx.Query(param); err != nil {
+			return err
+		}
+	} else if err := getJSON(t.url("search?"+searchQuery(param).Encode()), res); err != nil {
+		return err
+	}
+	return printJSON(res)
+}
+
+func get(args []string) error {
+	var t target
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	t.flags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := t.validate(); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: peanut get [flags] <pk>")
+	}
+	pk := fs.Arg(0)
+
+	if t.server != "" {
+		doc := new(index.Document)
+		if err := getJSON(t.url("documents?pk="+url.QueryEscape(pk)), doc); err != nil {
+			return err
+		}
+		return printJSON(doc)
+	}
+
+	idx, err := t.open()
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+
+	_, docs, err := idx.Search(&index.Param{PKs: []string{pk}, Size: 1})
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return index.ErrDocumentNotFound
+	}
+	return printJSON(docs[0])
+}
+
+func related(args []string) error {
+	var t target
+	fs := flag.NewFlagSet("related", flag.ContinueOnError)
+	t.flags(fs)
+	size := fs.Int("size", 10, "number of related documents")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := t.validate(); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: peanut related [flags] <pk>")
+	}
+	pk := fs.Arg(0)
+
+	res := new(index.Result)
+	if t.server != "" {
+		q := url.Values{"pk": {pk}, "size": {strconv.Itoa(*size)}}
+		if err := getJSON(t.url("related?"+q.Encode()), res); err != nil {
+			return err
+		}
+		return printJSON(res)
+	}
+
+	idx, err := t.open()
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+
+	if res, err = idx.MoreLikeThis(pk, *size); err != nil {
+		return err
+	}
+	return printJSON(res)
+}
+
+func deleteDocument(args []string) error {
+	var t target
+	fs := flag.NewFlagSet("delete", flag.ContinueOnError)
+	t.flags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := t.validate(); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: peanut delete [flags] <pk>")
+	}
+	pk := fs.Arg(0)
+
+	if t.server != "" {
+		req, err := http.NewRequest(http.MethodDelete, t.url("documents?pk="+url.QueryEscape(pk)), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return responseError(resp)
+		}
+		return nil
+	}
+
+	idx, err := t.open()
+	if err != nil {
+		return err
+	}
+	err = idx.DeleteDocument(pk)
+	if cerr := idx.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func incrPV(args []string) error {
+	var t target
+	fs := flag.NewFlagSet("pv", flag.ContinueOnError)
+	t.flags(fs)
+	delta := fs.Int("delta", 1, "views added to every pk")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := t.validate(); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: peanut pv [flags] <pk>...")
+	}
+	deltas := make(map[string]int, fs.NArg())
+	for _, pk := range fs.Args() {
+		deltas[pk] += *delta
+	}
+
+	pvs := make(map[string]int)
+	if t.server != "" {
+		body, err := json.Marshal(deltas)
+		if err != nil {
+			return err
+		}
+		resp, err := http.Post(t.url("pv"), "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return responseError(resp)
+		}
+		if err = json.NewDecoder(resp.Body).Decode(&pvs); err != nil {
+			return err
+		}
+	} else {
+		idx, err := t.open()
+		if err != nil {
+			return err
+		}
+		pvs, err = idx.IncrPVs(deltas)
+		if cerr := idx.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return printJSON(pvs)
+}
+
+func stats(args []string) error {
+	var t target
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	t.flags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := t.validate(); err != nil {
+		return err
+	}
+
+	buckets := make(map[string]int)
+	if t.server != "" {
+		if err := getJSON(strings.TrimSuffix(t.url(""), "/"), &buckets); err != nil {
+			return err
+		}
+	} else {
+		idx, err := t.open()
+		if err != nil {
+			return err
+		}
+		defer idx.Close()
+
+		if buckets, err = idx.Buckets(); err != nil {
+			return err
+		}
+	}
+
+	return printBuckets(os.Stdout, buckets)
+}
+
+// printBuckets prints the buckets sorted by name, the names are padded to the longest one.
+func printBuckets(w io.Writer, buckets map[string]int) error {
+	names := make([]string, 0, len(buckets))
+	width := 0
+	for name := range buckets {
+		names = append(names, name)
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "%-*s %d\n", width, name, buckets[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func categories(args []string) error {
+	var t target
+	fs := flag.NewFlagSet("categories", flag.ContinueOnError)
+	t.flags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := t.validate(); err != nil {
+		return err
+	}
+
+	tree := new(index.CategoryNode)
+	if t.server != "" {
+		if err := getJSON(t.url("categories"), tree); err != nil {
+			return err
+		}
+	} else {
+		idx, err := t.open()
+		if err != nil {
+			return err
+		}
+		defer idx.Close()
+
+		if tree, err = idx.CategoryTree(); err != nil {
+			return err
+		}
+	}
+
+	var printNode func(node *index.CategoryNode, depth int)
+	printNode = func(node *index.CategoryNode, depth int) {
+		for _, child := range node.Children {
+			fmt.Printf("%s%s\t%d\n", strings.Repeat("  ", depth), child.Name, child.Count)
+			printNode(child, depth+1)
+		}
+	}
+	printNode(tree, 0)
+	return nil
+}
+
+func dumpTerms(args []string) error {
+	var t target
+	fs := flag.NewFlagSet("dump-terms", flag.ContinueOnError)
+	t.flags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if t.server != "" {
+		return fmt.Errorf("dump-terms reads the index file, use -db")
+	}
+	if err := t.validate(); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: peanut dump-terms [flags] <%s>", strings.Join(index.Fields, "|"))
+	}
+
+	idx, err := t.open()
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+
+	return idx.ForEachTerm(fs.Arg(0), func(term string, docIds []uint32) error {
+		_, err := fmt.Printf("%s\t%d\t%v\n", term, len(docIds), docIds)
+		return err
+	})
+}
+
+func getJSON(u string, v interface{}) error {
+	resp, err := http.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(v)
+}
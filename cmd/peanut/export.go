@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/mnhkahn/peanut/index"
+)
+
+func export(args []string) error {
+	var t target
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	t.flags(fs)
+	out := fs.String("o", "", "NDJSON file, stdout if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := t.validate(); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if t.db != "" {
+		n, err := index.ExportFile(t.db, w)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "export %d documents.\n", n)
+		return nil
+	}
+
+	resp, err := http.Get(t.url("export"))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func importDocuments(args []string) error {
+	var t target
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	t.flags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := t.validate(); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: peanut index [flags] file.jsonl")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var n int
+	if t.db != "" {
+		idx, err := t.open()
+		if err != nil {
+			return err
+		}
+		n, err = idx.Import(f)
+		if cerr := idx.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("%s, %d documents imported", err, n)
+		}
+	} else {
+		resp, err := http.Post(t.url("import"), "application/x-ndjson", f)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return responseError(resp)
+		}
+		var res struct {
+			Imported int `json:"imported"`
+		}
+		if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			return err
+		}
+		n = res.Imported
+	}
+
+	fmt.Fprintf(os.Stderr, "import %d documents.\n", n)
+	return nil
+}
@@ -0,0 +1,151 @@
+// Command peanut runs the peanut server and operates an index from the shell.
+//
+//	peanut serve [-config file] [-data-path dir] ...
+//	peanut index [target] file.jsonl
+//	peanut search [target] [-tags t1,t2] [-category c] [-offset n] [-size n] [-sort pv] [-asc] <query>
+//	peanut get [target] <pk>
+//	peanut related [target] [-size n] <pk>
+//	peanut delete [target] <pk>
+//	peanut pv [target] [-delta n] <pk>...
+//	peanut stats [target]
+//	peanut dump-terms [target] <pk|title|brief|full_text|tags|category>
+//	peanut categories [target]
+//	peanut check [target] [-repair]
+//	peanut compact [target]
+//	peanut backup [target] [-o file]
+//	peanut restore [target] snapshot
+//	peanut export [target] [-o file.jsonl]
+//	peanut import [target] file.jsonl
+//
+// target is the index file of a stopped server, -db file (default $PEANUT_DB) with
+// -dictionary files (default $PEANUT_DICTIONARY or ./dictionary.txt), or an index of a
+// running server, -server url -index name.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mnhkahn/peanut"
+	"github.com/mnhkahn/peanut/index"
+)
+
+// command is a subcommand, it parses its own args.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]*command{
+	"serve":      {"run the server, see the config flags with serve -h", serve},
+	"index":      {"add the documents of a NDJSON file to an index", importDocuments},
+	"search":     {"search an index", search},
+	"get":        {"print the document of a pk", get},
+	"related":    {"print the documents related to the document of a pk", related},
+	"delete":     {"delete the document of a pk", deleteDocument},
+	"pv":         {"add views to the pv of documents", incrPV},
+	"stats":      {"print the number of entries of every bucket", stats},
+	"dump-terms": {"print the terms of a field with their posting lists", dumpTerms},
+	"categories": {"print the category tree with the number of documents", categories},
+	"check":      {"check the consistency of an index, and fix it with -repair", check},
+	"compact":    {"drop the dead postings of an index and shrink its file", compact},
+	"backup":     {"write a snapshot of an index", backup},
+	"restore":    {"replace an index with a snapshot", restore},
+	"export":     {"write the documents of an index as NDJSON", export},
+	"import":     {"same as index", importDocuments},
+}
+
+// errUsage is returned by run for a missing or an unknown command.
+var errUsage = errors.New("usage: peanut <command> [args]")
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		switch err {
+		case errUsage:
+			usage()
+			os.Exit(2)
+		case flag.ErrHelp:
+		default:
+			fmt.Fprintln(os.Stderr, "peanut:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// run runs the command of args[0] with the rest of args.
+func run(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %s\n", args[0])
+		return errUsage
+	}
+	return cmd.run(args[1:])
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: peanut <command> [args]")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, commands[name].usage)
+	}
+}
+
+func serve(args []string) error {
+	return peanut.Run(args)
+}
+
+// target is an index reached through a running server or a closed index file.
+type target struct {
+	server     string
+	index      string
+	db         string
+	dictionary string
+}
+
+func (t *target) flags(fs *flag.FlagSet) {
+	fs.StringVar(&t.server, "server", "", "url of a running server, e.g. http://127.0.0.1:1031")
+	fs.StringVar(&t.index, "index", "", "index name, used with -server")
+	fs.StringVar(&t.db, "db", os.Getenv("PEANUT_DB"), "index file of a stopped server")
+	dictionary := index.DefaultOptions.Dictionary
+	if v := os.Getenv("PEANUT_DICTIONARY"); v != "" {
+		dictionary = v
+	}
+	fs.StringVar(&t.dictionary, "dictionary", dictionary, "sego dictionary files separated by comma, used with -db")
+}
+
+// open opens the index file of t.
+func (t *target) open() (*index.Index, error) {
+	opts := index.DefaultOptions
+	opts.Dictionary = t.dictionary
+	return index.NewIndexWithOptions(t.db, opts)
+}
+
+func (t *target) validate() error {
+	if t.server != "" && t.db == os.Getenv("PEANUT_DB") {
+		// -server wins over $PEANUT_DB.
+		t.db = ""
+	}
+	if (t.server == "") == (t.db == "") {
+		return fmt.Errorf("one of -server and -db is required")
+	}
+	if t.server != "" && t.index == "" {
+		return fmt.Errorf("-index is required with -server")
+	}
+	return nil
+}
+
+// url returns the url of the resource of the index on the server.
+func (t *target) url(resource string) string {
+	return strings.TrimSuffix(t.server, "/") + "/indexes/" + t.index + "/" + resource
+}
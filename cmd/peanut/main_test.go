@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mnhkahn/peanut/index"
+	"github.com/stretchr/testify/assert"
+)
+
+// capture returns what f prints to stdout.
+func capture(t *testing.T, f func() error) (string, error) {
+	r, w, err := os.Pipe()
+	assert.Nil(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		out <- buf.String()
+	}()
+	err = f()
+	w.Close()
+	return <-out, err
+}
+
+func TestTargetURL(t *testing.T) {
+	for _, c := range []struct {
+		server, resource, url string
+	}{
+		{"http://127.0.0.1:1031", "documents?pk=a", "http://127.0.0.1:1031/indexes/blog/documents?pk=a"},
+		{"http://127.0.0.1:1031/", "search?q=go", "http://127.0.0.1:1031/indexes/blog/search?q=go"},
+		{"http://127.0.0.1:1031/", "", "http://127.0.0.1:1031/indexes/blog/"},
+	} {
+		tg := &target{server: c.server, index: "blog"}
+		assert.Equal(t, c.url, tg.url(c.resource), c.server)
+	}
+}
+
+func TestTargetFlags(t *testing.T) {
+	os.Setenv("PEANUT_DB", "env.db")
+	defer os.Unsetenv("PEANUT_DB")
+
+	for _, c := range []struct {
+		args   []string
+		server string
+		db     string
+		err    string
+	}{
+		{args: nil, db: "env.db"},
+		{args: []string{"-db", "a.db"}, db: "a.db"},
+		{args: []string{"-server", "http://s", "-index", "blog"}, server: "http://s"},
+		{args: []string{"-server", "http://s"}, err: "-index is required with -server"},
+		{args: []string{"-server", "http://s", "-index", "blog", "-db", "a.db"}, err: "one of -server and -db is required"},
+		{args: []string{"-db", ""}, err: "one of -server and -db is required"},
+	} {
+		var tg target
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		tg.flags(fs)
+		assert.Nil(t, fs.Parse(c.args))
+		err := tg.validate()
+		if c.err != "" {
+			assert.EqualError(t, err, c.err, "%v", c.args)
+			continue
+		}
+		assert.Nil(t, err, "%v", c.args)
+		assert.Equal(t, c.server, tg.server, "%v", c.args)
+		assert.Equal(t, c.db, tg.db, "%v", c.args)
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peanut-cmd")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db := filepath.Join(dir, "blog.db")
+	dictionary := "../../index/dictionary.txt"
+	opts := index.DefaultOptions
+	opts.Dictionary = dictionary
+	idx, err := index.NewIndexWithOptions(db, opts)
+	assert.Nil(t, err)
+	assert.Nil(t, idx.AddDocuments(&index.Document{PK: "a", Title: "golang"}))
+	assert.Nil(t, idx.Close())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/indexes/blog":
+			json.NewEncoder(w).Encode(map[string]int{"FullTextReverse": 12, "PK": 1})
+		case "/indexes/blog/documents":
+			json.NewEncoder(w).Encode(&index.Document{PK: r.URL.Query().Get("pk"), Title: "server"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	for _, c := range []struct {
+		args []string
+		out  string
+		err  error
+	}{
+		{args: nil, err: errUsage},
+		{args: []string{"unknown"}, err: errUsage},
+		{args: []string{"get", "-h"}, err: flag.ErrHelp},
+		{args: []string{"get", "-db", db, "-dictionary", dictionary, "a"}, out: `"title": "golang"`},
+		{args: []string{"get", "-server", server.URL, "-index", "blog", "a"}, out: `"title": "server"`},
+		{args: []string{"get", "-db", db, "-dictionary", dictionary, "b"}, err: index.ErrDocumentNotFound},
+		{args: []string{"stats", "-server", server.URL, "-index", "blog"}, out: "FullTextReverse 12\nPK              1\n"},
+	} {
+		out, err := capture(t, func() error { return run(c.args) })
+		assert.Equal(t, c.err, err, "%v", c.args)
+		assert.Contains(t, out, c.out, "%v", c.args)
+	}
+}
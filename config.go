@@ -0,0 +1,239 @@
+// Package peanut
+package peanut
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mnhkahn/peanut/index"
+)
+
+// envPrefix is the prefix of the environment variables, e.g. PEANUT_ADDR.
+const envPrefix = "PEANUT_"
+
+// Duration is a time.Duration read from json as "10s" or as nanoseconds.
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON ...
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON ...
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		d.Duration = time.Duration(value)
+	case string:
+		var err error
+		d.Duration, err = time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid duration: %s", string(b))
+	}
+	return nil
+}
+
+// Config is the configuration of a peanut server.
+type Config struct {
+	// DataPath is the directory of the index files.
+	DataPath string `json:"data_path"`
+	// Dictionary is the sego dictionary files separated by comma.
+	Dictionary string `json:"dictionary"`
+	// SearchMode segments text into finer terms, an index keeps the mode it's created with.
+	SearchMode bool `json:"search_mode"`
+	// Addr is the listen address, e.g. ":1031".
+	Addr string `json:"addr"`
+	// HandleLimit is the max number of requests handled at the same time, 0 means no limit.
+	HandleLimit int `json:"handle_limit"`
+	// MaxPageSize is the largest page size of a search.
+	MaxPageSize int `json:"max_page_size"`
+	// RefreshInterval is how often the documents queued with ?async=true are indexed.
+	RefreshInterval Duration `json:"refresh_interval"`
+	// PVFlushInterval is how often the pv increments are written to the index files.
+	PVFlushInterval Duration `json:"pv_flush_interval"`
+	// Duplicates is what is done with a new document whose full text is a near duplicate,
+	// "" indexes it, "reject" or "merge" into the stored one.
+	Duplicates string `json:"duplicates"`
+	// DuplicateDistance is the largest Hamming distance of near duplicates, 0 to 3.
+	DuplicateDistance int `json:"duplicate_distance"`
+
+	ReadTimeout     Duration `json:"read_timeout"`
+	WriteTimeout    Duration `json:"write_timeout"`
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+}
+
+// DefaultConfig returns the config used when nothing is set.
+func DefaultConfig() *Config {
+	return &Config{
+		DataPath:        "./data",
+		Dictionary:      "./dictionary.txt",
+		Addr:            ":1031",
+		MaxPageSize:     100,
+		RefreshInterval: Duration{time.Second},
+		PVFlushInterval: Duration{5 * time.Second},
+		ReadTimeout:     Duration{10 * time.Second},
+		WriteTimeout:    Duration{10 * time.Second},
+		ShutdownTimeout: Duration{30 * time.Second},
+	}
+}
+
+// LoadConfig builds the config from the defaults, then the json file set by -config,
+// then PEANUT_* environment variables, then the command line args. A later source
+// overrides an earlier one.
+func LoadConfig(args []string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	fs := flag.NewFlagSet("peanut", flag.ContinueOnError)
+	path := fs.String("config", "", "json config file")
+	flags := cfg.flagSet(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		if err := cfg.LoadFile(*path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.LoadEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	// only the flags set explicitly override the file and the environment.
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if set, ok := flags[f.Name]; ok && err == nil {
+			err = set(f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// LoadFile reads the json config file at path, the missing keys are kept.
+func (cfg *Config) LoadFile(path string) error {
+	byts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(byts, cfg); err != nil {
+		return fmt.Errorf("config %s: %s", path, err)
+	}
+	return nil
+}
+
+// LoadEnv reads PEANUT_* variables, e.g. PEANUT_DATA_PATH or PEANUT_HANDLE_LIMIT.
+func (cfg *Config) LoadEnv(lookup func(string) (string, bool)) error {
+	for name, set := range cfg.setters() {
+		key := envPrefix + strings.ToUpper(name)
+		if v, ok := lookup(key); ok {
+			if err := set(v); err != nil {
+				return fmt.Errorf("%s: %s", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// flagSet defines a flag for each config key on fs, it returns the setters of the keys.
+func (cfg *Config) flagSet(fs *flag.FlagSet) map[string]func(string) error {
+	res := make(map[string]func(string) error)
+	for name, set := range cfg.setters() {
+		flagName := strings.Replace(name, "_", "-", -1)
+		fs.String(flagName, "", "overrides "+name)
+		res[flagName] = set
+	}
+	return res
+}
+
+// setters returns a setter from string for every config key.
+func (cfg *Config) setters() map[string]func(string) error {
+	str := func(p *string) func(string) error {
+		return func(v string) error { *p = v; return nil }
+	}
+	integer := func(p *int) func(string) error {
+		return func(v string) (err error) { *p, err = strconv.Atoi(v); return }
+	}
+	boolean := func(p *bool) func(string) error {
+		return func(v string) (err error) { *p, err = strconv.ParseBool(v); return }
+	}
+	duration := func(p *Duration) func(string) error {
+		return func(v string) (err error) { p.Duration, err = time.ParseDuration(v); return }
+	}
+
+	return map[string]func(string) error{
+		"data_path":          str(&cfg.DataPath),
+		"dictionary":         str(&cfg.Dictionary),
+		"search_mode":        boolean(&cfg.SearchMode),
+		"addr":               str(&cfg.Addr),
+		"handle_limit":       integer(&cfg.HandleLimit),
+		"max_page_size":      integer(&cfg.MaxPageSize),
+		"refresh_interval":   duration(&cfg.RefreshInterval),
+		"pv_flush_interval":  duration(&cfg.PVFlushInterval),
+		"duplicates":         str(&cfg.Duplicates),
+		"duplicate_distance": integer(&cfg.DuplicateDistance),
+		"read_timeout":       duration(&cfg.ReadTimeout),
+		"write_timeout":      duration(&cfg.WriteTimeout),
+		"shutdown_timeout":   duration(&cfg.ShutdownTimeout),
+	}
+}
+
+// Validate checks every value of the config.
+func (cfg *Config) Validate() error {
+	if cfg.DataPath == "" {
+		return fmt.Errorf("data_path can't be empty")
+	}
+	if cfg.Dictionary == "" {
+		return fmt.Errorf("dictionary can't be empty")
+	}
+	for _, file := range strings.Split(cfg.Dictionary, ",") {
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("dictionary: %s", err)
+		}
+	}
+	if _, _, err := net.SplitHostPort(cfg.Addr); err != nil {
+		return fmt.Errorf("addr: %s", err)
+	}
+	if cfg.HandleLimit < 0 {
+		return fmt.Errorf("handle_limit can't be negative: %d", cfg.HandleLimit)
+	}
+	if cfg.MaxPageSize <= 0 {
+		return fmt.Errorf("max_page_size must be positive: %d", cfg.MaxPageSize)
+	}
+	if cfg.ReadTimeout.Duration < 0 || cfg.WriteTimeout.Duration < 0 || cfg.ShutdownTimeout.Duration < 0 ||
+		cfg.RefreshInterval.Duration < 0 || cfg.PVFlushInterval.Duration < 0 {
+		return fmt.Errorf("durations can't be negative")
+	}
+	switch cfg.Duplicates {
+	case index.DuplicatesAllow, index.DuplicatesReject, index.DuplicatesMerge:
+	default:
+		return fmt.Errorf("duplicates is %q or %q: %s", index.DuplicatesReject, index.DuplicatesMerge, cfg.Duplicates)
+	}
+	if cfg.DuplicateDistance < 0 || cfg.DuplicateDistance > index.MaxDuplicateDistance {
+		return fmt.Errorf("duplicate_distance is in [0, %d]: %d", index.MaxDuplicateDistance, cfg.DuplicateDistance)
+	}
+	return nil
+}
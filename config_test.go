@@ -0,0 +1,39 @@
+// Package peanut
+package peanut
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	file, err := ioutil.TempFile("", "peanut-conf")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(`{"addr": ":8080", "handle_limit": 5, "read_timeout": "3s", "dictionary": "./index/dictionary.txt"}`)
+	assert.Nil(t, err)
+	file.Close()
+
+	os.Setenv("PEANUT_HANDLE_LIMIT", "7")
+	os.Setenv("PEANUT_DATA_PATH", "/tmp/peanut-env")
+	defer os.Unsetenv("PEANUT_HANDLE_LIMIT")
+	defer os.Unsetenv("PEANUT_DATA_PATH")
+
+	cfg, err := LoadConfig([]string{"-config", file.Name(), "-data-path", "/tmp/peanut-flag"})
+	assert.Nil(t, err)
+	assert.Equal(t, ":8080", cfg.Addr)
+	assert.Equal(t, 7, cfg.HandleLimit)
+	assert.Equal(t, "/tmp/peanut-flag", cfg.DataPath)
+	assert.Equal(t, 3*time.Second, cfg.ReadTimeout.Duration)
+	assert.Equal(t, 100, cfg.MaxPageSize)
+
+	_, err = LoadConfig([]string{"-config", file.Name(), "-addr", "nope"})
+	assert.NotNil(t, err)
+
+	_, err = LoadConfig([]string{"-dictionary", "/not/exists.txt"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,172 @@
+package index
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/willf/bitset"
+)
+
+// Backup writes a consistent snapshot of the index to w while it's serving, it returns
+// the number of bytes written. The pv increments are flushed first, but the documents
+// still in the queue are not in the snapshot, call Refresh first to include them.
+func (index *Index) Backup(w io.Writer) (int64, error) {
+	if err := index.FlushPV(); err != nil {
+		return 0, err
+	}
+
+	var n int64
+	err := index._index.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// BackupFile writes a snapshot of the closed index file at path to w.
+func BackupFile(path string, w io.Writer) (int64, error) {
+	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return 0, fmt.Errorf("err: %s, %s", err, path)
+	}
+	defer db.Close()
+
+	var n int64
+	err = db.View(func(tx *bolt.Tx) error {
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// Restore replaces the index file at path with the snapshot read from r. The snapshot
+// is written next to path and validated first, path is left untouched if it's invalid.
+// The index at path must be closed.
+func Restore(path string, r io.Reader) error {
+	s, err := ReadSnapshot(filepath.Dir(path), r)
+	if err != nil {
+		return err
+	}
+	defer s.Discard()
+	return s.RestoreTo(path)
+}
+
+// Snapshot is a validated snapshot spooled to a file, see ReadSnapshot.
+type Snapshot struct {
+	path string
+}
+
+// ReadSnapshot writes the snapshot read from r to a temporary file in dir and validates
+// it. dir should be the directory of the index it restores, so RestoreTo is a rename.
+// Discard the snapshot if it isn't restored.
+func ReadSnapshot(dir string, r io.Reader) (*Snapshot, error) {
+	f, err := ioutil.TempFile(dir, ".restore-")
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{path: f.Name()}
+
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = ValidateSnapshot(s.path)
+	}
+	if err != nil {
+		s.Discard()
+		return nil, err
+	}
+	return s, nil
+}
+
+// RestoreTo replaces the index file at path with s, the index at path must be closed. The
+// file keeps the mode of the replaced one, or 0644 if there's none.
+func (s *Snapshot) RestoreTo(path string) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	// the temp file is 0600.
+	if err := os.Chmod(s.path, mode); err != nil {
+		return err
+	}
+
+	// the queued documents of the old index don't belong to the snapshot.
+	if err := os.Remove(path + ".wal"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(s.path, path); err != nil {
+		return err
+	}
+	s.path = ""
+	return nil
+}
+
+// Discard removes the file of s, it does nothing once s is restored.
+func (s *Snapshot) Discard() {
+	if s.path != "" {
+		os.Remove(s.path)
+		s.path = ""
+	}
+}
+
+// SnapshotError reports a snapshot that can't be restored.
+type SnapshotError struct {
+	Reason string
+}
+
+func (e *SnapshotError) Error() string {
+	return "invalid snapshot: " + e.Reason
+}
+
+func snapshotError(format string, a ...interface{}) error {
+	return &SnapshotError{Reason: fmt.Sprintf(format, a...)}
+}
+
+// ValidateSnapshot checks the bolt file at path is consistent and has every bucket of
+// an index.
+func ValidateSnapshot(path string) error {
+	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return snapshotError("%s", err)
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		// drain the channel, the checker holds the tx until it's done.
+		var checkErr error
+		for err := range tx.Check() {
+			if checkErr == nil {
+				checkErr = err
+			}
+		}
+		if checkErr != nil {
+			return snapshotError("%s", checkErr)
+		}
+
+		for _, name := range indexNames {
+			if tx.Bucket(name) == nil {
+				return snapshotError("bucket %s not found", name)
+			}
+		}
+
+		if byts := tx.Bucket(statusIndexName).Get(statusIndexName); byts != nil {
+			if err := bitset.New(1).UnmarshalBinary(byts); err != nil {
+				return snapshotError("status: %s", err)
+			}
+		}
+		return nil
+	})
+}
@@ -3,6 +3,7 @@ package index
 import (
 	"sync"
 
+	"github.com/boltdb/bolt"
 	"github.com/mnhkahn/gogogo/logger"
 	"github.com/willf/bitset"
 )
@@ -128,11 +129,44 @@ func (b *Bitmap) Uints(status bool) []uint32 {
 	return res
 }
 
+// All returns every docId set in order, unlike Uints it isn't capped.
+func (b *Bitmap) All() []uint32 {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	res := make([]uint32, 0, b.data.Count())
+	buf := make([]uint, 4096)
+	for i, buf := b.data.NextSetMany(0, buf); len(buf) > 0; i, buf = b.data.NextSetMany(i+1, buf) {
+		for _, docId := range buf {
+			res = append(res, uint32(docId))
+		}
+	}
+	return res
+}
+
+// SetFrom returns at most size docIds set from i on, in order.
+func (b *Bitmap) SetFrom(i uint32, size int) []uint32 {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	_, buf := b.data.NextSetMany(uint(i), make([]uint, size))
+	res := make([]uint32, 0, len(buf))
+	for _, docId := range buf {
+		res = append(res, uint32(docId))
+	}
+	return res
+}
+
 func (b *Bitmap) Backup() error {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
 
-	logger.Info("backup", string(b.btname), b.Len())
+	return b.backup()
+}
+
+// backup must be called with the lock held.
+func (b *Bitmap) backup() error {
+	logger.Info("backup", string(b.btname), b.data.Count())
 
 	byts, err := b.data.MarshalBinary()
 	if err != nil {
@@ -146,9 +180,53 @@ func (b *Bitmap) Backup() error {
 	return nil
 }
 
+// Clone returns a copy of the bits. A writer changes the copy in a transaction,
+// writes it by BackupTx and swaps it in by Swap once the transaction is committed.
+func (b *Bitmap) Clone() *bitset.BitSet {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return b.data.Clone()
+}
+
+// BackupTx writes data as the bitmap in tx.
+func (b *Bitmap) BackupTx(tx *bolt.Tx, data *bitset.BitSet) error {
+	byts, err := data.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return b.btree.SetTx(tx, b.btname, b.btname, byts)
+}
+
+// Swap replaces the bits in memory with data.
+func (b *Bitmap) Swap(data *bitset.BitSet) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.data = data
+}
+
+// Equal reports whether the bitmap holds the same bits as data, the lengths may differ.
+func (b *Bitmap) Equal(data *bitset.BitSet) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return b.data.SymmetricDifferenceCardinality(data) == 0
+}
+
+// Reset replaces all bits with data and backs it up.
+func (b *Bitmap) Reset(data *bitset.BitSet) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.data = data
+	return b.backup()
+}
+
+// Close flushes the bitmap to the btree.
 func (b *Bitmap) Close() error {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	return b.Backup()
+	return b.backup()
 }
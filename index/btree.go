@@ -8,6 +8,8 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -16,6 +18,8 @@ import (
 
 type BTree struct {
 	name string
+	// lock guards db, which is swapped by Compact.
+	lock sync.RWMutex
 	db   *bolt.DB
 }
 
@@ -36,67 +40,110 @@ func NewBTree(dbpath string) (*BTree, error) {
 	return t, nil
 }
 
+// GetDB returns the bolt db. It's unsafe across a Compact, which closes it and swaps in
+// a new one, so use View or Update instead.
 func (t *BTree) GetDB() *bolt.DB {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
 	return t.db
 }
 
 func (t *BTree) AddBTree(btname []byte) error {
-	tx, err := t.db.Begin(true)
-	if err != nil {
+	return t.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(btname)
 		return err
-	}
-	defer tx.Rollback()
+	})
+}
 
-	_, err = tx.CreateBucketIfNotExists(btname)
-	if err != nil {
-		return err
-	}
+// Update runs fn in a read-write transaction, all the changes of fn are committed
+// together or not at all.
+func (t *BTree) Update(fn func(tx *bolt.Tx) error) error {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
 
-	if err := tx.Commit(); err != nil {
-		return err
+	return t.db.Update(fn)
+}
+
+// View runs fn in a read-only transaction. fn mustn't call View or Update again, the
+// nested read lock waits behind a pending Compact which waits for fn.
+func (t *BTree) View(fn func(tx *bolt.Tx) error) error {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.db.View(fn)
+}
+
+func (t *BTree) bucket(tx *bolt.Tx, btname []byte) (*bolt.Bucket, error) {
+	b := tx.Bucket(btname)
+	if b == nil {
+		return nil, fmt.Errorf("Tablename[%v] not found", string(btname))
 	}
-	return nil
+	return b, nil
 }
 
 func (t *BTree) Set(btname, key []byte, value []byte) error {
-	return t.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(btname)
-		if b == nil {
-			return fmt.Errorf("Tablename[%v] not found", string(btname))
-		}
-		err := b.Put(key, value)
-		return err
+	return t.Update(func(tx *bolt.Tx) error {
+		return t.SetTx(tx, btname, key, value)
 	})
 }
 
-func (t *BTree) Delete(btname, key []byte) error {
-	return t.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(btname)
-		if b == nil {
-			return fmt.Errorf("Tablename[%v] not found", string(btname))
-		}
-		err := b.Delete(key)
+// SetTx puts key in tx.
+func (t *BTree) SetTx(tx *bolt.Tx, btname, key []byte, value []byte) error {
+	b, err := t.bucket(tx, btname)
+	if err != nil {
 		return err
+	}
+	return b.Put(key, value)
+}
+
+func (t *BTree) Delete(btname, key []byte) error {
+	return t.Update(func(tx *bolt.Tx) error {
+		return t.DeleteTx(tx, btname, key)
 	})
 }
 
+// DeleteTx deletes key in tx.
+func (t *BTree) DeleteTx(tx *bolt.Tx, btname, key []byte) error {
+	b, err := t.bucket(tx, btname)
+	if err != nil {
+		return err
+	}
+	return b.Delete(key)
+}
+
 func (t *BTree) Search(btname []byte, key []byte) ([]byte, bool, error) {
 	var value []byte
-	err := t.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(btname)
-		value = b.Get(key)
-
-		return nil
+	var exists bool
+	err := t.View(func(tx *bolt.Tx) error {
+		var err error
+		value, exists, err = t.SearchTx(tx, btname, key)
+		return err
 	})
 	if err != nil {
 		return nil, false, err
 	}
-	return value, len(value) > 0, nil
+	return value, exists, nil
+}
+
+// SearchTx gets key in tx, the value is copied so it's still valid after tx is closed.
+func (t *BTree) SearchTx(tx *bolt.Tx, btname []byte, key []byte) ([]byte, bool, error) {
+	b, err := t.bucket(tx, btname)
+	if err != nil {
+		return nil, false, err
+	}
+	v := b.Get(key)
+	if len(v) == 0 {
+		return nil, false, nil
+	}
+	value := make([]byte, len(v))
+	copy(value, v)
+	return value, true, nil
 }
 
 func (t *BTree) Prefix(btname []byte, prefix []byte) ([][]byte, [][]byte, bool, error) {
 	var keys, values [][]byte
-	err := t.db.View(func(tx *bolt.Tx) error {
+	err := t.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(btname).Cursor()
 		for k, v := b.Seek(prefix); bytes.HasPrefix(k, prefix); k, v = b.Next() {
 			keys = append(keys, k)
@@ -114,26 +161,14 @@ func (t *BTree) Prefix(btname []byte, prefix []byte) ([][]byte, [][]byte, bool,
 func (t *BTree) DeleteBTree(btname []byte) error {
 	logger.Info("clear bucket", string(btname))
 
-	tx, err := t.db.Begin(true)
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-
-	err = tx.DeleteBucket(btname)
-	if err != nil {
-		return err
-	}
-
-	if err := tx.Commit(); err != nil {
-		return err
-	}
-	return nil
+	return t.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(btname)
+	})
 }
 
 func (t *BTree) Len(btname []byte) int {
 	len := 0
-	t.db.View(func(tx *bolt.Tx) error {
+	t.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(btname)
 		len = b.Stats().KeyN
 		// b.ForEach(func(k, v []byte) error {
@@ -147,13 +182,16 @@ func (t *BTree) Len(btname []byte) int {
 }
 
 func (t *BTree) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
 	return t.db.Close()
 }
 
 func (t *BTree) Keys(btname []byte, len int) [][]byte {
 	res := make([][]byte, 0, len)
 	i := 0
-	t.db.View(func(tx *bolt.Tx) error {
+	t.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(btname)
 
 		b.ForEach(func(k, v []byte) error {
@@ -172,7 +210,7 @@ func (t *BTree) Keys(btname []byte, len int) [][]byte {
 }
 
 func (t *BTree) Debug(btname []byte) {
-	t.db.View(func(tx *bolt.Tx) error {
+	t.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(btname)
 
 		b.ForEach(func(k, v []byte) error {
@@ -182,3 +220,109 @@ func (t *BTree) Debug(btname []byte) {
 		return nil
 	})
 }
+
+// compactTxSize is the number of keys copied in one transaction by Compact.
+const compactTxSize = 10000
+
+// Compact copies every bucket into a new bolt file and swaps it in place of the db, bolt
+// never shrinks a file by itself. Reads and writes wait until the swap is done. It
+// returns the file size before and after.
+func (t *BTree) Compact() (int64, int64, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	before, err := fileSize(t.name)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tmp := t.name + ".compact"
+	os.Remove(tmp)
+	dst, err := bolt.Open(tmp, 0666, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return 0, 0, err
+	}
+	err = copyDB(dst, t.db)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, 0, err
+	}
+
+	if err = t.db.Close(); err != nil {
+		os.Remove(tmp)
+		return 0, 0, err
+	}
+	// the old file is reopened if the new one can't replace it.
+	if rerr := os.Rename(tmp, t.name); rerr != nil {
+		os.Remove(tmp)
+		err = rerr
+	}
+	db, err := reopen(t.name, err)
+	if db != nil {
+		t.db = db
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	after, err := fileSize(t.name)
+	return before, after, err
+}
+
+func reopen(path string, err error) (*bolt.DB, error) {
+	db, oerr := bolt.Open(path, 0666, &bolt.Options{Timeout: 1 * time.Second})
+	if oerr != nil {
+		return nil, fmt.Errorf("err: %s, %s", oerr, path)
+	}
+	return db, err
+}
+
+// copyDB copies the buckets of src into dst, compactTxSize keys per transaction.
+func copyDB(dst, src *bolt.DB) error {
+	return src.View(func(stx *bolt.Tx) error {
+		return stx.ForEach(func(name []byte, sb *bolt.Bucket) error {
+			dtx, err := dst.Begin(true)
+			if err != nil {
+				return err
+			}
+			defer func() { dtx.Rollback() }()
+
+			db, err := dtx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+
+			n := 0
+			c := sb.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				if v == nil {
+					return fmt.Errorf("nested bucket %s in %s isn't supported", k, name)
+				}
+				if err = db.Put(k, v); err != nil {
+					return err
+				}
+				if n++; n%compactTxSize == 0 {
+					if err = dtx.Commit(); err != nil {
+						return err
+					}
+					if dtx, err = dst.Begin(true); err != nil {
+						return err
+					}
+					db = dtx.Bucket(name)
+				}
+			}
+			return dtx.Commit()
+		})
+	})
+}
+
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,174 @@
+package index
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/mnhkahn/gods/xencoding"
+	"github.com/mnhkahn/gogogo/logger"
+	"github.com/vmihailenco/msgpack"
+	"github.com/willf/bitset"
+)
+
+// CategorySeparator separates the levels of a category path, e.g. "tech/go/json". A
+// document is indexed in every ancestor of its category, so filtering on "tech" matches
+// "tech/go/json" too.
+const CategorySeparator = "/"
+
+// categoryPathsKey is set in Meta once the categories of the documents indexed before the
+// paths are indexed by their ancestors too.
+var categoryPathsKey = []byte("category_paths")
+
+// Breadcrumb is a level of the category path of a document.
+type Breadcrumb struct {
+	Name string `json:"name"`
+	// Path is the lowercased path to filter the level by.
+	Path string `json:"path"`
+}
+
+// CategoryNode is a category of CategoryTree.
+type CategoryNode struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// Count is the number of documents of the category and its descendants.
+	Count    int             `json:"count"`
+	Children []*CategoryNode `json:"children,omitempty"`
+}
+
+// categoryLevels splits category into its levels without the empty ones.
+func categoryLevels(category string) []string {
+	var res []string
+	for _, level := range strings.Split(category, CategorySeparator) {
+		if level = strings.TrimSpace(level); level != "" {
+			res = append(res, level)
+		}
+	}
+	return res
+}
+
+// categoryPath returns the lowercased category with its empty levels removed, e.g.
+// " Tech//Go/ " is "tech/go".
+func categoryPath(category string) string {
+	return strings.ToLower(strings.Join(categoryLevels(category), CategorySeparator))
+}
+
+// categoryPaths returns the paths of category and its ancestors, the root first.
+func categoryPaths(category string) []string {
+	levels := categoryLevels(strings.ToLower(category))
+	res := make([]string, 0, len(levels))
+	for i := range levels {
+		res = append(res, strings.Join(levels[:i+1], CategorySeparator))
+	}
+	return res
+}
+
+// Breadcrumbs returns the levels of category, the root first.
+func Breadcrumbs(category string) []*Breadcrumb {
+	levels := categoryLevels(category)
+	res := make([]*Breadcrumb, 0, len(levels))
+	for i, level := range levels {
+		res = append(res, &Breadcrumb{Name: level, Path: strings.ToLower(strings.Join(levels[:i+1], CategorySeparator))})
+	}
+	return res
+}
+
+// CategoryTree returns the categories of the live documents as a tree, the root is the
+// documents with a category. A document is counted once in the deepest path it's indexed
+// in, the count of a category is the sum of its own and its children's.
+func (index *Index) CategoryTree() (*CategoryNode, error) {
+	// docId => the deepest path of the document.
+	leaves := make(map[uint32]string)
+	err := index._index.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(categoryIndexName).ForEach(func(k, v []byte) error {
+			for _, docId := range xencoding.Bytes2Uints(v) {
+				// the paths of a document are its ancestors, the deepest is the longest.
+				if index.status.Test(docId) && len(k) > len(leaves[docId]) {
+					leaves[docId] = string(k)
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	root := &CategoryNode{}
+	nodes := map[string]*CategoryNode{"": root}
+	// node returns the node of path, its missing ancestors are added, e.g. a document
+	// indexed before the paths, see migrateCategoryPaths.
+	var node func(path string) *CategoryNode
+	node = func(path string) *CategoryNode {
+		if n, ok := nodes[path]; ok {
+			return n
+		}
+		parent, name := "", path
+		if i := strings.LastIndex(path, CategorySeparator); i >= 0 {
+			parent, name = path[:i], path[i+1:]
+		}
+		p := node(parent)
+		n := &CategoryNode{Name: name, Path: path}
+		nodes[path] = n
+		p.Children = append(p.Children, n)
+		return n
+	}
+	for _, path := range leaves {
+		node(path).Count++
+	}
+	sumCategories(root)
+	return root, nil
+}
+
+// sumCategories adds the counts of the descendants of node to it and sorts its children by
+// path.
+func sumCategories(node *CategoryNode) int {
+	sort.Slice(node.Children, func(i, j int) bool { return node.Children[i].Path < node.Children[j].Path })
+	for _, child := range node.Children {
+		node.Count += sumCategories(child)
+	}
+	return node.Count
+}
+
+// migrateCategoryPaths indexes the documents in the paths of their categories once, if they
+// were indexed by their lowercased categories before the paths. A document is moved from
+// its old term if it isn't one of its paths, e.g. "tech//go" or "go ".
+func (index *Index) migrateCategoryPaths() error {
+	done, _, err := index._index.Search(metaIndexName, categoryPathsKey)
+	if err != nil || done != nil {
+		return err
+	}
+
+	return index.writer.write(func(tx *bolt.Tx, status *bitset.BitSet) error {
+		n := 0
+		err := tx.Bucket(documentIndexName).ForEach(func(k, v []byte) error {
+			docId := xencoding.Bytes2Uint(k)
+			if !status.Test(uint(docId)) {
+				return nil
+			}
+			doc := new(Document)
+			if err := msgpack.Unmarshal(v, doc); err != nil || doc.Category == "" {
+				return nil
+			}
+			old, paths := strings.ToLower(doc.Category), categoryPaths(doc.Category)
+			if len(paths) == 1 && paths[0] == old {
+				return nil
+			}
+			n++
+			if err := index.category.deleteTermsTx(tx, []string{old}, paths, docId); err != nil {
+				return err
+			}
+			for _, path := range paths {
+				if err := index.category.AppendBytesUintsTx(tx, []byte(path), docId); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		logger.Infof("index the category paths of %d documents.", n)
+		return index._index.SetTx(tx, metaIndexName, categoryPathsKey, []byte{1})
+	})
+}
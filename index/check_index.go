@@ -0,0 +1,278 @@
+package index
+
+import (
+	"sort"
+
+	"github.com/boltdb/bolt"
+	"github.com/mnhkahn/gods/xencoding"
+	"github.com/mnhkahn/gogogo/logger"
+	"github.com/vmihailenco/msgpack"
+	"github.com/willf/bitset"
+)
+
+// PostingIssue is a term whose posting list is broken.
+type PostingIssue struct {
+	Field  string   `json:"field"`
+	Term   string   `json:"term"`
+	DocIds []uint32 `json:"doc_ids,omitempty"`
+}
+
+// DuplicatePK is a pk that maps to more than one live document.
+type DuplicatePK struct {
+	PK     string   `json:"pk"`
+	DocIds []uint32 `json:"doc_ids"`
+}
+
+// CheckReport is the result of Check, or what Repair fixed.
+type CheckReport struct {
+	// Documents is the number of live documents.
+	Documents int `json:"documents"`
+	// OrphanPostings are postings to a docId without a live document, DocIds are the
+	// orphans. A pk posting to a document with another pk is an orphan too.
+	OrphanPostings []*PostingIssue `json:"orphan_postings"`
+	// UnsortedPostings are posting lists not strictly increasing.
+	UnsortedPostings []*PostingIssue `json:"unsorted_postings"`
+	// MissingDocuments are docIds set in the status bitmap without a document.
+	MissingDocuments []uint32 `json:"missing_documents"`
+	// DeadDocuments are documents stored for a docId cleared in the status bitmap.
+	DeadDocuments []uint32 `json:"dead_documents"`
+	// UndecodableDocuments are documents that aren't valid msgpack.
+	UndecodableDocuments []uint32 `json:"undecodable_documents"`
+	// DuplicatePKs are pks of more than one live document.
+	DuplicatePKs []*DuplicatePK `json:"duplicate_pks"`
+}
+
+// Problems returns the number of problems found.
+func (r *CheckReport) Problems() int {
+	return len(r.OrphanPostings) + len(r.UnsortedPostings) + len(r.MissingDocuments) +
+		len(r.DeadDocuments) + len(r.UndecodableDocuments) + len(r.DuplicatePKs)
+}
+
+// OK reports whether the index is consistent.
+func (r *CheckReport) OK() bool {
+	return r.Problems() == 0
+}
+
+// Check verifies that the status bitmap, the documents, the pks and the posting lists
+// agree, on a consistent snapshot of the index.
+func (index *Index) Check() (*CheckReport, error) {
+	var report *CheckReport
+	err := index._index.View(func(tx *bolt.Tx) error {
+		status := bitset.New(1)
+		if byts := tx.Bucket(statusIndexName).Get(statusIndexName); byts != nil {
+			if err := status.UnmarshalBinary(byts); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		report, err = index.checkTx(tx, status, false)
+		return err
+	})
+	return report, err
+}
+
+// Repair fixes the problems found by Check and returns them: undecodable documents are
+// removed, the status bitmap follows the stored documents, a duplicate pk keeps its
+// highest docId, and every posting list is sorted and keeps only live documents. The
+// values derived from a removed document are removed with it, the ones of a kept
+// duplicate are written again.
+func (index *Index) Repair() (*CheckReport, error) {
+	var report *CheckReport
+	err := index.writer.write(func(tx *bolt.Tx, status *bitset.BitSet) error {
+		var err error
+		report, err = index.checkTx(tx, status, true)
+		return err
+	})
+	return report, err
+}
+
+// postingFields returns the inverted indexes keyed by term.
+func (index *Index) postingFields() []*InvertIndex {
+	return []*InvertIndex{index.pk, index.title, index.brief, index.fullText, index.tag, index.category, index.simHashes}
+}
+
+// checkTx checks the index in tx, and fixes it if repair is set.
+func (index *Index) checkTx(tx *bolt.Tx, status *bitset.BitSet, repair bool) (*CheckReport, error) {
+	report := new(CheckReport)
+
+	// docId => pk of the live documents.
+	live := make(map[uint32]string)
+	stored := make(map[uint32]bool)
+	err := tx.Bucket(documentIndexName).ForEach(func(k, v []byte) error {
+		docId := xencoding.Bytes2Uint(k)
+		stored[docId] = true
+		if !status.Test(uint(docId)) {
+			report.DeadDocuments = append(report.DeadDocuments, docId)
+			return nil
+		}
+		doc := new(Document)
+		if err := msgpack.Unmarshal(v, doc); err != nil {
+			report.UndecodableDocuments = append(report.UndecodableDocuments, docId)
+			return nil
+		}
+		live[docId] = doc.PK
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, ok := status.NextSet(0); ok; i, ok = status.NextSet(i + 1) {
+		if !stored[uint32(i)] {
+			report.MissingDocuments = append(report.MissingDocuments, uint32(i))
+		}
+	}
+
+	err = tx.Bucket(pkIndexName).ForEach(func(k, v []byte) error {
+		var docIds []uint32
+		for _, docId := range uniqueUints(xencoding.Bytes2Uints(v)) {
+			if pk, ok := live[docId]; ok && pk == string(k) {
+				docIds = append(docIds, docId)
+			}
+		}
+		if len(docIds) > 1 {
+			report.DuplicatePKs = append(report.DuplicatePKs, &DuplicatePK{PK: string(k), DocIds: docIds})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if repair {
+		// the postings of the removed documents are rewritten below.
+		for _, docIds := range [][]uint32{report.DeadDocuments, report.UndecodableDocuments, report.MissingDocuments} {
+			for _, docId := range docIds {
+				if err = index.removeDocumentTx(tx, status, docId); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	// the postings are checked against the live documents, and rewritten against the
+	// live documents once the duplicates are removed.
+	final := live
+	if repair && len(report.DuplicatePKs) > 0 {
+		final = make(map[uint32]string, len(live))
+		for docId, pk := range live {
+			final[docId] = pk
+		}
+		for _, dup := range report.DuplicatePKs {
+			for _, docId := range dup.DocIds[:len(dup.DocIds)-1] {
+				logger.Warnf("repair: remove docId %d of duplicate pk %s.", docId, dup.PK)
+				delete(final, docId)
+				if err = index.removeDocumentTx(tx, status, docId); err != nil {
+					return nil, err
+				}
+			}
+			if err = index.rederiveTx(tx, dup.DocIds[len(dup.DocIds)-1]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, field := range index.postingFields() {
+		isPK := field == index.pk
+		alive := func(docs map[uint32]string, term string, docId uint32) bool {
+			pk, ok := docs[docId]
+			return ok && (!isPK || pk == term)
+		}
+
+		var rewrites []*PostingIssue
+		err = tx.Bucket(field.btname).ForEach(func(k, v []byte) error {
+			term := string(k)
+			docIds := xencoding.Bytes2Uints(v)
+
+			if !sort.SliceIsSorted(docIds, func(i, j int) bool { return docIds[i] < docIds[j] }) ||
+				len(uniqueUints(docIds)) != len(docIds) {
+				report.UnsortedPostings = append(report.UnsortedPostings, &PostingIssue{Field: string(field.btname), Term: term})
+			}
+
+			var orphans []uint32
+			for _, docId := range docIds {
+				if !alive(live, term, docId) {
+					orphans = append(orphans, docId)
+				}
+			}
+			if len(orphans) > 0 {
+				report.OrphanPostings = append(report.OrphanPostings, &PostingIssue{Field: string(field.btname), Term: term, DocIds: orphans})
+			}
+
+			if repair {
+				var res []uint32
+				for _, docId := range uniqueUints(docIds) {
+					if alive(final, term, docId) {
+						res = append(res, docId)
+					}
+				}
+				if !equalUints(res, docIds) {
+					rewrites = append(rewrites, &PostingIssue{Term: term, DocIds: res})
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// a bucket can't be changed while it's iterated.
+		for _, rw := range rewrites {
+			if len(rw.DocIds) == 0 {
+				err = field.deleteTermTx(tx, []byte(rw.Term))
+			} else {
+				err = index._index.SetTx(tx, field.btname, []byte(rw.Term), xencoding.Uints2Bytes(rw.DocIds))
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	report.Documents = len(final)
+	return report, nil
+}
+
+// rederiveTx writes the values derived from the document of docId again.
+func (index *Index) rederiveTx(tx *bolt.Tx, docId uint32) error {
+	doc, err := index.documentTx(tx, docId)
+	if err != nil || doc == nil {
+		return err
+	}
+	if err = index.setDocValuesTx(tx, docId, doc); err != nil {
+		return err
+	}
+	if err = index.setSimHashTx(tx, docId, doc); err != nil {
+		return err
+	}
+	return index.setGroupValuesTx(tx, docId, doc)
+}
+
+// uniqueUints returns the sorted docIds without duplicates, docIds is left untouched.
+func uniqueUints(docIds []uint32) []uint32 {
+	res := make([]uint32, len(docIds))
+	copy(res, docIds)
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+
+	n := 0
+	for i, docId := range res {
+		if i == 0 || docId != res[n-1] {
+			res[n] = docId
+			n++
+		}
+	}
+	return res[:n]
+}
+
+func equalUints(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package index
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/mnhkahn/gods/xencoding"
+	"github.com/mnhkahn/gogogo/logger"
+	"github.com/willf/bitset"
+)
+
+// CompactReport is the result of Compact.
+type CompactReport struct {
+	// RemovedPostings is the number of dead docIds removed from the posting lists.
+	RemovedPostings int `json:"removed_postings"`
+	// DroppedTerms is the number of terms left without documents.
+	DroppedTerms int `json:"dropped_terms"`
+	// RemovedDocuments is the number of documents stored for a dead docId.
+	RemovedDocuments int `json:"removed_documents"`
+	// SizeBefore and SizeAfter are the sizes of the bolt file in bytes.
+	SizeBefore int64 `json:"size_before"`
+	SizeAfter  int64 `json:"size_after"`
+}
+
+// Compact removes the docIds cleared in the status bitmap from the posting lists, drops
+// the terms left empty, and rewrites the bolt file so it shrinks. Searches and writes
+// wait while the file is rewritten.
+func (index *Index) Compact() (*CompactReport, error) {
+	var report *CompactReport
+	err := index.writer.write(func(tx *bolt.Tx, status *bitset.BitSet) error {
+		// the writer may run the op again, only the counts of the committed run are kept.
+		counts := new(CompactReport)
+		if err := index.compactPostingsTx(tx, status, counts); err != nil {
+			return err
+		}
+		report = counts
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report.SizeBefore, report.SizeAfter, err = index._index.Compact()
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("compact index %s: %+v", index._index.name, report)
+	return report, nil
+}
+
+func (index *Index) compactPostingsTx(tx *bolt.Tx, status *bitset.BitSet, report *CompactReport) error {
+	var dead [][]byte
+	err := tx.Bucket(documentIndexName).ForEach(func(k, v []byte) error {
+		if !status.Test(uint(xencoding.Bytes2Uint(k))) {
+			dead = append(dead, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range dead {
+		if err = index._index.DeleteTx(tx, documentIndexName, k); err != nil {
+			return err
+		}
+		if err = index.deleteDocValuesTx(tx, xencoding.Bytes2Uint(k)); err != nil {
+			return err
+		}
+		if err = index.deleteGroupValuesTx(tx, xencoding.Bytes2Uint(k)); err != nil {
+			return err
+		}
+	}
+	report.RemovedDocuments += len(dead)
+
+	for _, field := range index.postingFields() {
+		var rewrites []*PostingIssue
+		err = tx.Bucket(field.btname).ForEach(func(k, v []byte) error {
+			docIds := xencoding.Bytes2Uints(v)
+			live := make([]uint32, 0, len(docIds))
+			for _, docId := range docIds {
+				if status.Test(uint(docId)) {
+					live = append(live, docId)
+				}
+			}
+			if len(live) < len(docIds) {
+				report.RemovedPostings += len(docIds) - len(live)
+				rewrites = append(rewrites, &PostingIssue{Term: string(k), DocIds: live})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// a bucket can't be changed while it's iterated.
+		for _, rw := range rewrites {
+			if len(rw.DocIds) == 0 {
+				report.DroppedTerms++
+				err = field.deleteTermTx(tx, []byte(rw.Term))
+			} else {
+				err = index._index.SetTx(tx, field.btname, []byte(rw.Term), xencoding.Uints2Bytes(rw.DocIds))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package index
+
+import (
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/mnhkahn/gogogo/logger"
+	"github.com/willf/bitset"
+)
+
+// counters holds the pv increments not flushed yet, by pk. They are added to the pv doc
+// values of the docId the pk has when they are flushed, so the increments of a deleted pk
+// never count for the next document of its docId. The stored documents aren't rewritten.
+type counters struct {
+	index    *Index
+	interval time.Duration
+
+	lock    sync.Mutex
+	pending map[string]int64
+	closed  bool
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newCounters(index *Index, interval time.Duration) *counters {
+	c := new(counters)
+	c.index = index
+	c.interval = interval
+	c.pending = make(map[string]int64)
+	c.quit = make(chan struct{})
+
+	if interval > 0 {
+		c.wg.Add(1)
+		go c.run()
+	}
+	return c
+}
+
+func (c *counters) run() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.flush(); err != nil {
+				logger.Warnf("flush pv: %v", err)
+			}
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// add adds the deltas, they're flushed at once if there's no flush interval.
+func (c *counters) add(deltas map[string]int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return ErrIndexClosed
+	}
+	for pk, delta := range deltas {
+		c.pending[pk] += delta
+	}
+	if c.interval <= 0 {
+		return c.flushLocked()
+	}
+	return nil
+}
+
+// values returns the pv of docIds, the flushed value plus the pending delta. A flush
+// doesn't run meanwhile, so a delta is counted once.
+func (c *counters) values(docIds []uint32) ([][]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	values, err := c.index.readDocValues("pv", docIds)
+	if err != nil || len(c.pending) == 0 {
+		return values, err
+	}
+	pks, err := c.index.readDocValues("pk", docIds)
+	if err != nil {
+		return nil, err
+	}
+	for i, pk := range pks {
+		if delta, exists := c.pending[string(pk)]; exists && pk != nil {
+			values[i] = encodeInt(decodeInt(values[i]) + delta)
+		}
+	}
+	return values, nil
+}
+
+// forget drops the pending delta of pk, e.g. its pv is replaced.
+func (c *counters) forget(pk string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.pending, pk)
+}
+
+// reset drops every pending delta.
+func (c *counters) reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.pending = make(map[string]int64)
+}
+
+func (c *counters) flush() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.flushLocked()
+}
+
+// flushLocked adds the pending deltas to the pv doc values in one write, the deltas are
+// kept if it fails. The deltas of the pks deleted meanwhile are dropped.
+func (c *counters) flushLocked() error {
+	if len(c.pending) == 0 {
+		return nil
+	}
+
+	err := c.index.writer.write(func(tx *bolt.Tx, status *bitset.BitSet) error {
+		for pk, delta := range c.pending {
+			docIds, exists, err := c.index.pk.SearchBytesUintsTx(tx, []byte(pk))
+			if err != nil {
+				return err
+			} else if !exists || len(docIds) != 1 || !status.Test(uint(docIds[0])) {
+				continue
+			}
+			docId := docIds[0]
+			key := docValueKey("pv", docId)
+			pv, _, err := c.index._index.SearchTx(tx, docValuesIndexName, key)
+			if err != nil {
+				return err
+			}
+			if err = c.index._index.SetTx(tx, docValuesIndexName, key, encodeInt(decodeInt(pv)+delta)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.pending = make(map[string]int64)
+	return nil
+}
+
+// close flushes the pending deltas and stops the flushing.
+func (c *counters) close() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.lock.Unlock()
+
+	close(c.quit)
+	c.wg.Wait()
+	return c.flush()
+}
+
+// IncrPV adds delta to the pv of the document of pk and returns the new pv. The pv is
+// counted apart from the stored document, it's sorted by and returned at once and
+// written to the bolt file every Options.PVFlushInterval.
+func (index *Index) IncrPV(pk string, delta int) (int, error) {
+	pvs, err := index.IncrPVs(map[string]int{pk: delta})
+	if err != nil {
+		return 0, err
+	}
+	pv, exists := pvs[pk]
+	if !exists {
+		return 0, ErrDocumentNotFound
+	}
+	return pv, nil
+}
+
+// IncrPVs adds the deltas to the pv of the documents of their pk, see IncrPV. It returns
+// the new pv by pk, the pks without a document are left out.
+func (index *Index) IncrPVs(deltas map[string]int) (map[string]int, error) {
+	docIds := make(map[string]uint32, len(deltas))
+	byPK := make(map[string]int64, len(deltas))
+	for pk, delta := range deltas {
+		ids, err := index.SearchPks(pk)
+		if err != nil {
+			return nil, err
+		} else if len(ids) == 0 {
+			continue
+		}
+		docIds[pk] = ids[0]
+		byPK[pk] += int64(delta)
+	}
+
+	if err := index.counters.add(byPK); err != nil {
+		return nil, err
+	}
+
+	pks := make([]string, 0, len(docIds))
+	ids := make([]uint32, 0, len(docIds))
+	for pk, docId := range docIds {
+		pks = append(pks, pk)
+		ids = append(ids, docId)
+	}
+	values, err := index.counters.values(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]int, len(pks))
+	for i, pk := range pks {
+		res[pk] = int(decodeInt(values[i]))
+	}
+	return res, nil
+}
+
+// FlushPV writes the pending pv increments to the bolt file.
+func (index *Index) FlushPV() error {
+	return index.counters.flush()
+}
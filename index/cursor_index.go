@@ -0,0 +1,54 @@
+package index
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// ParamError reports an invalid search param.
+type ParamError struct {
+	Name   string
+	Reason string
+}
+
+func (e *ParamError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Name, e.Reason)
+}
+
+// Cursor is the position of a hit in the sorted results: its sort key and its docId,
+// which breaks the ties. Param.SearchAfter set to the cursor of the last hit of a page
+// returns the next page, it doesn't move when documents are added before it.
+type Cursor struct {
+	Values [][]byte `msgpack:"v"`
+	DocId  uint32   `msgpack:"d"`
+}
+
+// String encodes the cursor for a url.
+func (c *Cursor) String() string {
+	b, err := msgpack.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ParseCursor decodes a cursor encoded by Cursor.String.
+func ParseCursor(s string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, &ParamError{Name: "search_after", Reason: "malformed cursor"}
+	}
+	c := new(Cursor)
+	if err = msgpack.Unmarshal(b, c); err != nil {
+		return nil, &ParamError{Name: "search_after", Reason: "malformed cursor"}
+	}
+	// a value is never empty, an empty one is missing.
+	for i, v := range c.Values {
+		if len(v) == 0 {
+			c.Values[i] = nil
+		}
+	}
+	return c, nil
+}
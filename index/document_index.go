@@ -1,15 +1,104 @@
 package index
 
+import "strings"
+
 // Param is search param.
 type Param struct {
-	PKs      []string
-	Query    string
+	PKs   []string
+	Query string
+	// Wildcards reads a word of Query with * or ? as a wildcard and a word between slashes
+	// as a regexp, e.g. json*, *处理 or /js(on|onp)/. They match the terms of the title,
+	// brief and full text, and need a literal prefix or suffix.
+	Wildcards bool
+	// Tags is the same as TagsAny.
 	Tags     []string
 	Category string
 
+	// TagsAll matches the documents with all of the tags, TagsAny with any of them and
+	// TagsNone with none of them.
+	TagsAll  []string
+	TagsAny  []string
+	TagsNone []string
+	// Categories matches the documents in any of the categories, CategoriesNone in none
+	// of them. Category and Categories must both match if they are set.
+	Categories     []string
+	CategoriesNone []string
+
 	Offset int
 	Size   int
 	Sort   Sorter
+	// SortBy sorts by a list of clauses, it replaces Sort if it isn't empty.
+	SortBy []SortClause
+	// FunctionScore blends the score with the pub_date and the pv of a document.
+	FunctionScore *FunctionScore
+	// SearchAfter returns the hits following the cursor, see Result.Next.
+	SearchAfter *Cursor
+	// CollapseDuplicates keeps the first hit of the near duplicates, see Result.Collapsed.
+	CollapseDuplicates bool
+	// CollapseBy keeps the first hit of every group of a field, see CollapseByCategory.
+	CollapseBy string
+	// GroupSize returns the first GroupSize hits of every group of CollapseBy in
+	// Result.Groups, Offset and Size page the groups.
+	GroupSize int
+
+	// Explain asks Query to explain every hit and trace the search.
+	Explain bool
+}
+
+// Ops of a termFilter.
+const (
+	filterAny  = ""
+	filterAll  = "all"
+	filterNone = "none"
+)
+
+// termFilter is a filter of a Param on the tags or the category.
+type termFilter struct {
+	field string
+	op    string
+	terms []string
+}
+
+// name is e.g. tags, tags_all or category_none.
+func (f *termFilter) name() string {
+	if f.op == filterAny {
+		return f.field
+	}
+	return f.field + "_" + f.op
+}
+
+// termFilters returns the tags and category filters of param, the terms are lowercased
+// as they are indexed and the categories are paths.
+func (param *Param) termFilters() []*termFilter {
+	var res []*termFilter
+	add := func(field, op string, terms ...string) {
+		if field == "category" {
+			paths := make([]string, 0, len(terms))
+			for _, t := range terms {
+				paths = append(paths, categoryPath(t))
+			}
+			terms = paths
+		}
+		if terms = lowerTerms(terms); len(terms) > 0 {
+			res = append(res, &termFilter{field: field, op: op, terms: terms})
+		}
+	}
+	add("tags", filterAny, append(append([]string(nil), param.Tags...), param.TagsAny...)...)
+	add("tags", filterAll, param.TagsAll...)
+	add("tags", filterNone, param.TagsNone...)
+	add("category", filterAny, param.Category)
+	add("category", filterAny, param.Categories...)
+	add("category", filterNone, param.CategoriesNone...)
+	return res
+}
+
+// lowerTerms lowercases terms without the empty and the duplicate ones.
+func lowerTerms(terms []string) []string {
+	res := make([]string, 0, len(terms))
+	for _, t := range terms {
+		res = append(res, strings.ToLower(t))
+	}
+	return uniqueTerms(res)
 }
 
 type Sorter struct {
@@ -0,0 +1,114 @@
+package index
+
+import (
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/mnhkahn/gods/xencoding"
+	"github.com/mnhkahn/gogogo/logger"
+	"github.com/vmihailenco/msgpack"
+	"github.com/willf/bitset"
+)
+
+// docValuesIndexName is the bucket of the sort values of the documents, it's derived
+// from the documents and rebuilt on open if it's empty.
+var docValuesIndexName = []byte("DocValues")
+
+// SortFields are the fields a document can be sorted by, besides SortByScore.
+var SortFields = []string{"pk", "title", "pub_date", "pv"}
+
+// docValues returns the sort values of doc encoded for bytes.Compare, in the order of
+// SortFields. An empty pk, title or a zero pub_date is missing and nil.
+func docValues(doc *Document) [][]byte {
+	values := make([][]byte, len(SortFields))
+	if doc.PK != "" {
+		values[0] = []byte(doc.PK)
+	}
+	if doc.Title != "" {
+		values[1] = []byte(strings.ToLower(doc.Title))
+	}
+	if doc.PubDate != 0 {
+		values[2] = encodeInt(doc.PubDate)
+	}
+	values[3] = encodeInt(int64(doc.PV))
+	return values
+}
+
+// docValueKey is | field | 0 | docId |.
+func docValueKey(field string, docId uint32) []byte {
+	return append(append([]byte(field), 0), xencoding.Uint2Bytes(docId)...)
+}
+
+func (index *Index) setDocValuesTx(tx *bolt.Tx, docId uint32, doc *Document) error {
+	for i, v := range docValues(doc) {
+		var err error
+		if v == nil {
+			err = index._index.DeleteTx(tx, docValuesIndexName, docValueKey(SortFields[i], docId))
+		} else {
+			err = index._index.SetTx(tx, docValuesIndexName, docValueKey(SortFields[i], docId), v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteDocValuesTx deletes the sort values and the fingerprint of docId, the posting
+// lists of the fingerprint bands are left to deleteSimHashTx or Compact.
+func (index *Index) deleteDocValuesTx(tx *bolt.Tx, docId uint32) error {
+	for _, field := range append([]string{simHashField}, SortFields...) {
+		if err := index._index.DeleteTx(tx, docValuesIndexName, docValueKey(field, docId)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// docValuesOf returns the values of field for docIds, a missing value is nil. The pv
+// counts the increments not flushed yet.
+func (index *Index) docValuesOf(field string, docIds []uint32) ([][]byte, error) {
+	if field == "pv" && index.counters != nil {
+		return index.counters.values(docIds)
+	}
+	return index.readDocValues(field, docIds)
+}
+
+// readDocValues reads the values of field for docIds from the bolt file.
+func (index *Index) readDocValues(field string, docIds []uint32) ([][]byte, error) {
+	res := make([][]byte, len(docIds))
+	err := index._index.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(docValuesIndexName)
+		for i, docId := range docIds {
+			if v := b.Get(docValueKey(field, docId)); v != nil {
+				res[i] = append([]byte(nil), v...)
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+// buildDocValues writes the doc values of every live document if the bucket is empty,
+// e.g. the index was created before doc values were.
+func (index *Index) buildDocValues() error {
+	if index._index.Len(docValuesIndexName) > 0 || index.status.Len() == 0 {
+		return nil
+	}
+
+	logger.Infof("build doc values of %d documents.", index.status.Len())
+	return index.writer.write(func(tx *bolt.Tx, status *bitset.BitSet) error {
+		return tx.Bucket(documentIndexName).ForEach(func(k, v []byte) error {
+			docId := xencoding.Bytes2Uint(k)
+			if !status.Test(uint(docId)) {
+				return nil
+			}
+			doc := new(Document)
+			if err := msgpack.Unmarshal(v, doc); err != nil {
+				logger.Warnf("doc values of document %d: %v", docId, err)
+				return nil
+			}
+			return index.setDocValuesTx(tx, docId, doc)
+		})
+	})
+}
@@ -0,0 +1,271 @@
+package index
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/mnhkahn/gods/xsort"
+)
+
+// SortByScore is the Sorter.Field that sorts by the relevance score of the query.
+const SortByScore = "score"
+
+// fieldBoosts weights a query term by the field it's found in, tags and category are
+// weighted by MoreLikeThis.
+var fieldBoosts = map[string]float64{
+	"title":     3,
+	"brief":     2,
+	"full_text": 1,
+	"tags":      2,
+	"category":  1,
+}
+
+// Result is the result of Query.
+type Result struct {
+	Total int    `json:"total"`
+	Hits  []*Hit `json:"hits"`
+	// Next is the cursor of the next page, it's empty on the last page.
+	Next string `json:"next,omitempty"`
+	// Collapsed is the number of hits left out by Param.CollapseDuplicates and
+	// Param.CollapseBy, they aren't in Total.
+	Collapsed int `json:"collapsed,omitempty"`
+	// Groups are the groups of Param.GroupSize instead of Hits, Total is the number of
+	// groups.
+	Groups []*Group `json:"groups,omitempty"`
+	// Trace is how the posting lists were combined, set if Param.Explain is.
+	Trace []*TraceStep `json:"trace,omitempty"`
+}
+
+// Hit is a document of a result.
+type Hit struct {
+	*Document
+	DocId uint32  `json:"doc_id"`
+	Score float64 `json:"score"`
+	// Breadcrumbs are the levels of the category path.
+	Breadcrumbs []*Breadcrumb `json:"breadcrumbs,omitempty"`
+	// Group is the group of Param.CollapseBy and Collapsed the number of its other hits.
+	Group     string `json:"group,omitempty"`
+	Collapsed int    `json:"collapsed,omitempty"`
+	// Explanation is set if Param.Explain is.
+	Explanation *Explanation `json:"explanation,omitempty"`
+}
+
+// Explanation tells why a document matched and where it's ranked.
+type Explanation struct {
+	// Matches are the matched terms per field.
+	Matches map[string][]string `json:"matches"`
+	// Filters are the pk, tags and category filters applied.
+	Filters []string `json:"filters,omitempty"`
+	// Scores are the parts of the score, one per matched query term and field.
+	Scores []*TermScore `json:"scores,omitempty"`
+	// Function is the factors of Param.FunctionScore.
+	Function *FunctionFactors `json:"function,omitempty"`
+	// Sort is the values of the sort clauses of the document.
+	Sort string `json:"sort"`
+}
+
+// TermScore is the score of a query term found in a field: Boost * IDF.
+type TermScore struct {
+	Field   string  `json:"field"`
+	Term    string  `json:"term"`
+	DocFreq int     `json:"doc_freq"`
+	IDF     float64 `json:"idf"`
+	Boost   float64 `json:"boost"`
+	Score   float64 `json:"score"`
+}
+
+// TraceStep is a step of a search, DocIds is the number of docIds it results in.
+type TraceStep struct {
+	Op     string   `json:"op"`
+	Detail string   `json:"detail,omitempty"`
+	Terms  []string `json:"terms,omitempty"`
+	DocIds int      `json:"doc_ids"`
+}
+
+// tracer records the steps of a search, a nil tracer records nothing.
+type tracer struct {
+	steps []*TraceStep
+}
+
+func (t *tracer) add(op, detail string, terms []string, docIds int) {
+	if t == nil {
+		return
+	}
+	t.steps = append(t.steps, &TraceStep{Op: op, Detail: detail, Terms: terms, DocIds: docIds})
+}
+
+// termPostings is the posting list of terms in a field, op is the termFilter op of a
+// filter.
+type termPostings struct {
+	field  string
+	op     string
+	terms  []string
+	docIds []uint32
+}
+
+// matches is what search found for a param.
+type matches struct {
+	total     int
+	collapsed int
+	page      []uint32
+	next      *Cursor
+	// groupOf and collapsedOf are the group and the number of collapsed docIds of the
+	// docIds kept by Param.CollapseBy, groups the page of Param.GroupSize.
+	groupOf     map[uint32]string
+	collapsedOf map[uint32]int
+	groups      []*group
+	// keywords are the postings of the query terms, filters of the pk, tags and category.
+	keywords []*termPostings
+	filters  []*termPostings
+	// scores of the query terms, by keyword.
+	weights []*TermScore
+	// function blends the scores, now is the time of the search in seconds.
+	function *FunctionScore
+	now      int64
+}
+
+// Query searches param like Search, every hit has its score, and is explained with a
+// trace of the search if param.Explain is set.
+func (index *Index) Query(param *Param) (*Result, error) {
+	var tr *tracer
+	if param != nil && param.Explain {
+		tr = new(tracer)
+	}
+
+	m, err := index.search(param, tr)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Result{Total: m.total, Collapsed: m.collapsed, Hits: make([]*Hit, 0, len(m.page))}
+	if m.next != nil {
+		res.Next = m.next.String()
+	}
+	scores, err := index.scores(m, m.page)
+	if err != nil {
+		return nil, err
+	}
+	var factors []*FunctionFactors
+	if param.Explain {
+		if factors, err = index.functionFactors(m, m.page); err != nil {
+			return nil, err
+		}
+	}
+	for i, doc := range index.ToDocuments(m.page...) {
+		hit := &Hit{Document: doc, DocId: m.page[i], Score: scores[i], Group: m.groupOf[m.page[i]], Collapsed: m.collapsedOf[m.page[i]]}
+		hit.Breadcrumbs = Breadcrumbs(doc.Category)
+		if param.Explain {
+			hit.Explanation = index.explain(m, param, m.page[i], doc, scores[i])
+			if factors != nil {
+				hit.Explanation.Function = factors[i]
+			}
+		}
+		res.Hits = append(res.Hits, hit)
+	}
+	if m.groups != nil {
+		res.Groups = make([]*Group, 0, len(m.groups))
+		hits := res.Hits
+		for _, g := range m.groups {
+			res.Groups = append(res.Groups, &Group{Key: g.key, Total: g.total, Hits: hits[:len(g.docIds)]})
+			hits = hits[len(g.docIds):]
+		}
+		res.Hits = []*Hit{}
+	}
+	if tr != nil {
+		res.Trace = tr.steps
+	}
+	return res, nil
+}
+
+// relevance returns the score of docId for the query terms of m and its parts.
+func (index *Index) relevance(m *matches, docId uint32) (float64, []*TermScore) {
+	if m.weights == nil {
+		n := float64(index.status.Len())
+		m.weights = make([]*TermScore, 0, len(m.keywords))
+		for _, p := range m.keywords {
+			df := index.liveCount(p.docIds)
+			idf := math.Log(1 + (n-float64(df)+0.5)/(float64(df)+0.5))
+			boost := fieldBoosts[p.field]
+			m.weights = append(m.weights, &TermScore{Field: p.field, Term: p.terms[0], DocFreq: df, IDF: idf, Boost: boost, Score: boost * idf})
+		}
+	}
+
+	var score float64
+	var scores []*TermScore
+	for i, p := range m.keywords {
+		if xsort.SearchUIntsExists(p.docIds, docId) >= 0 {
+			score += m.weights[i].Score
+			scores = append(scores, m.weights[i])
+		}
+	}
+	return score, scores
+}
+
+func (index *Index) explain(m *matches, param *Param, docId uint32, doc *Document, score float64) *Explanation {
+	_, scores := index.relevance(m, docId)
+	e := &Explanation{Matches: make(map[string][]string), Scores: scores}
+	for _, s := range scores {
+		e.Matches[s.Field] = append(e.Matches[s.Field], s.Term)
+	}
+
+	for _, f := range m.filters {
+		switch f.op {
+		case filterAll:
+			e.Filters = append(e.Filters, fmt.Sprintf("%s all of %v", f.field, f.terms))
+		case filterNone:
+			e.Filters = append(e.Filters, fmt.Sprintf("%s none of %v", f.field, f.terms))
+		default:
+			e.Filters = append(e.Filters, fmt.Sprintf("%s in %v", f.field, f.terms))
+		}
+	}
+	for _, pk := range param.PKs {
+		if pk == doc.PK {
+			e.Matches["pk"] = append(e.Matches["pk"], pk)
+		}
+	}
+	docTags := make(map[string]bool, len(doc.Tags))
+	for _, t := range doc.Tags {
+		docTags[strings.ToLower(t)] = true
+	}
+	docPaths := make(map[string]bool)
+	for _, path := range categoryPaths(doc.Category) {
+		docPaths[path] = true
+	}
+	for _, f := range param.termFilters() {
+		if f.op == filterNone {
+			continue
+		}
+		for _, term := range f.terms {
+			if (f.field == "tags" && docTags[term]) || (f.field == "category" && docPaths[term]) {
+				e.Matches[f.field] = append(e.Matches[f.field], term)
+			}
+		}
+	}
+	if len(e.Matches["tags"]) > 0 {
+		e.Matches["tags"] = uniqueTerms(e.Matches["tags"])
+	}
+	if len(e.Matches["category"]) > 0 {
+		e.Matches["category"] = uniqueTerms(e.Matches["category"])
+	}
+
+	sorts := make([]string, 0, len(param.sortClauses()))
+	for _, c := range param.sortClauses() {
+		var v interface{}
+		switch c.Field {
+		case SortByScore:
+			v = score
+		case "pk":
+			v = doc.PK
+		case "title":
+			v = doc.Title
+		case "pub_date":
+			v = doc.PubDate
+		case "pv":
+			v = doc.PV
+		}
+		sorts = append(sorts, fmt.Sprintf("%s=%v", c.Field, v))
+	}
+	e.Sort = strings.Join(sorts, ", ")
+	return e
+}
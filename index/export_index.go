@@ -0,0 +1,184 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/mnhkahn/gods/xencoding"
+	"github.com/mnhkahn/gogogo/logger"
+	"github.com/vmihailenco/msgpack"
+	"github.com/willf/bitset"
+)
+
+// importBatchSize is the number of imported documents indexed in one transaction.
+const importBatchSize = 256
+
+// Export writes every live document of the index to w as NDJSON, one json document per
+// line, it returns the number of documents written. The documents are read from a
+// consistent snapshot while the index keeps serving.
+func (index *Index) Export(w io.Writer) (int, error) {
+	if err := index.FlushPV(); err != nil {
+		return 0, err
+	}
+
+	var n int
+	err := index._index.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = exportTx(tx, w)
+		return err
+	})
+	return n, err
+}
+
+// ExportFile writes the live documents of the closed index file at path to w as NDJSON.
+func ExportFile(path string, w io.Writer) (int, error) {
+	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return 0, fmt.Errorf("err: %s, %s", err, path)
+	}
+	defer db.Close()
+
+	var n int
+	err = db.View(func(tx *bolt.Tx) error {
+		n, err = exportTx(tx, w)
+		return err
+	})
+	return n, err
+}
+
+func exportTx(tx *bolt.Tx, w io.Writer) (int, error) {
+	// the status of the same snapshot, the bitmap in memory may be newer.
+	status := bitset.New(1)
+	if bucket := tx.Bucket(statusIndexName); bucket != nil {
+		if byts := bucket.Get(statusIndexName); byts != nil {
+			if err := status.UnmarshalBinary(byts); err != nil {
+				return 0, err
+			}
+		}
+	}
+	bucket := tx.Bucket(documentIndexName)
+	if bucket == nil {
+		return 0, nil
+	}
+	// the pv counters, a file older than them has none.
+	docValues := tx.Bucket(docValuesIndexName)
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+
+	n := 0
+	err := bucket.ForEach(func(k, v []byte) error {
+		docId := xencoding.Bytes2Uint(k)
+		if !status.Test(uint(docId)) {
+			return nil
+		}
+		doc := new(Document)
+		if err := msgpack.Unmarshal(v, doc); err != nil {
+			return fmt.Errorf("decode document %d: %s", docId, err)
+		}
+		if docValues != nil {
+			if pv := docValues.Get(docValueKey("pv", docId)); pv != nil {
+				doc.PV = int(decodeInt(pv))
+			}
+		}
+		n++
+		return enc.Encode(doc)
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// Import indexes the NDJSON documents read from r, see ReadNDJSON. A document replaces
+// the stored one with the same pk, a near duplicate rejected by Options.Duplicates is
+// skipped. It returns the number of documents indexed.
+func (index *Index) Import(r io.Reader) (int, error) {
+	rejected := 0
+	n, err := ReadNDJSON(r, importBatchSize, func(docs []*Document) error {
+		err := index.AddDocuments(docs...)
+		if e, ok := err.(*RejectedError); ok {
+			logger.Warnf("import: skip %d near duplicates, %s", len(e.Duplicates), e.Duplicates[0])
+			rejected += len(e.Duplicates)
+			return nil
+		}
+		return err
+	})
+	return n - rejected, err
+}
+
+// LineError reports a line of NDJSON that isn't a valid document.
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+// ReadNDJSON decodes a json document per line of r and calls fn with batches of at most
+// size documents. Blank lines are skipped, a line that isn't a document with a pk stops
+// the read with a *LineError after the documents before it are passed to fn. It returns the number of documents passed to fn without error.
+func ReadNDJSON(r io.Reader, size int, fn func(docs []*Document) error) (int, error) {
+	br := bufio.NewReader(r)
+
+	n := 0
+	docs := make([]*Document, 0, size)
+	flush := func() error {
+		if len(docs) == 0 {
+			return nil
+		}
+		if err := fn(docs); err != nil {
+			return err
+		}
+		n += len(docs)
+		docs = make([]*Document, 0, size)
+		return nil
+	}
+
+	for line := 1; ; line++ {
+		byts, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+
+		if trimmed := bytes.TrimSpace(byts); len(trimmed) > 0 {
+			doc := new(Document)
+			lerr := json.Unmarshal(trimmed, doc)
+			if lerr == nil && doc.PK == "" {
+				lerr = errors.New("document pk is required")
+			}
+			if lerr != nil {
+				// the documents before the bad line are indexed.
+				if ferr := flush(); ferr != nil {
+					return n, ferr
+				}
+				return n, &LineError{Line: line, Err: lerr}
+			}
+
+			docs = append(docs, doc)
+			if len(docs) >= size {
+				if ferr := flush(); ferr != nil {
+					return n, ferr
+				}
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if err := flush(); err != nil {
+		return n, err
+	}
+	return n, nil
+}
@@ -0,0 +1,174 @@
+package index
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Decay functions of a Decay.
+const (
+	DecayGauss = "gauss"
+	DecayExp   = "exp"
+)
+
+// DefaultDecay is the factor at Offset+Scale from Origin when Decay.Decay is 0.
+const DefaultDecay = 0.5
+
+// FunctionScore blends the relevance score of a query with the freshness and the
+// popularity of a document:
+//
+//	score = relevance * decay(pub_date) * (1 + ln(1 + PVFactor*pv))
+//
+// The relevance is 1 if the query has no terms, e.g. "*". A Param with a FunctionScore
+// and no sort is sorted by the score.
+type FunctionScore struct {
+	// Decay of pub_date, nil doesn't decay.
+	Decay *Decay `json:"decay,omitempty"`
+	// PVFactor scales pv in the popularity factor, 0 ignores pv.
+	PVFactor float64 `json:"pv_factor,omitempty"`
+}
+
+// Decay lowers the score of a document as its pub_date, in seconds, gets far from
+// Origin: not within Offset, then by Decay at Offset+Scale. A missing pub_date is as
+// far as it can be.
+type Decay struct {
+	// Func is DecayGauss or DecayExp.
+	Func string `json:"func"`
+	// Origin is the pub_date of the full score, 0 is now.
+	Origin int64         `json:"origin,omitempty"`
+	Offset time.Duration `json:"offset,omitempty"`
+	Scale  time.Duration `json:"scale"`
+	// Decay is in (0, 1), DefaultDecay if 0.
+	Decay float64 `json:"decay,omitempty"`
+}
+
+// FunctionFactors are the factors of a FunctionScore applied to a document.
+type FunctionFactors struct {
+	Relevance  float64 `json:"relevance"`
+	Decay      float64 `json:"decay"`
+	Popularity float64 `json:"popularity"`
+}
+
+// String returns e.g. "gauss(pub_date, offset 0s, scale 168h0m0s, decay 0.5) * log1p(0.1 * pv)".
+func (f *FunctionScore) String() string {
+	s := "relevance"
+	if d := f.Decay; d != nil {
+		s += fmt.Sprintf(" * %s(pub_date, offset %s, scale %s, decay %g)", d.Func, d.Offset, d.Scale, d.decay())
+	}
+	if f.PVFactor != 0 {
+		s += fmt.Sprintf(" * log1p(%g * pv)", f.PVFactor)
+	}
+	return s
+}
+
+func (f *FunctionScore) validate() error {
+	if f.PVFactor < 0 {
+		return &ParamError{Name: "pv_factor", Reason: "can't be negative"}
+	}
+	d := f.Decay
+	if d == nil {
+		return nil
+	}
+	if d.Func != DecayGauss && d.Func != DecayExp {
+		return &ParamError{Name: "decay", Reason: fmt.Sprintf("function is %s or %s", DecayGauss, DecayExp)}
+	}
+	if d.Scale < time.Second {
+		return &ParamError{Name: "decay_scale", Reason: "must be at least 1s"}
+	}
+	if d.Offset < 0 {
+		return &ParamError{Name: "decay_offset", Reason: "can't be negative"}
+	}
+	if d.Decay < 0 || d.Decay >= 1 {
+		return &ParamError{Name: "decay_factor", Reason: "must be in (0, 1)"}
+	}
+	return nil
+}
+
+func (d *Decay) decay() float64 {
+	if d.Decay == 0 {
+		return DefaultDecay
+	}
+	return d.Decay
+}
+
+// factor returns the decay of pubDate, now is the origin if Origin is 0.
+func (d *Decay) factor(pubDate, now int64) float64 {
+	origin := d.Origin
+	if origin == 0 {
+		origin = now
+	}
+	dist := math.Abs(float64(origin-pubDate)) - d.Offset.Seconds()
+	if dist <= 0 {
+		return 1
+	}
+
+	x := dist / d.Scale.Seconds()
+	if d.Func == DecayGauss {
+		x *= x
+	}
+	return math.Pow(d.decay(), x)
+}
+
+// functionFactors returns the factors of m.function for docIds, nil if it isn't set.
+func (index *Index) functionFactors(m *matches, docIds []uint32) ([]*FunctionFactors, error) {
+	f := m.function
+	if f == nil {
+		return nil, nil
+	}
+
+	var pubDates, pvs [][]byte
+	var err error
+	if f.Decay != nil {
+		if pubDates, err = index.docValuesOf("pub_date", docIds); err != nil {
+			return nil, err
+		}
+	}
+	if f.PVFactor != 0 {
+		if pvs, err = index.docValuesOf("pv", docIds); err != nil {
+			return nil, err
+		}
+	}
+
+	res := make([]*FunctionFactors, len(docIds))
+	for i, docId := range docIds {
+		ff := &FunctionFactors{Relevance: 1, Decay: 1, Popularity: 1}
+		if len(m.keywords) > 0 {
+			ff.Relevance, _ = index.relevance(m, docId)
+		}
+		if f.Decay != nil {
+			ff.Decay = f.Decay.factor(decodeInt(pubDates[i]), m.now)
+		}
+		if f.PVFactor != 0 {
+			ff.Popularity = 1 + math.Log1p(f.PVFactor*math.Max(0, float64(decodeInt(pvs[i]))))
+		}
+		res[i] = ff
+	}
+	return res, nil
+}
+
+// scores returns the scores of docIds: the relevance, blended by m.function if it's set.
+func (index *Index) scores(m *matches, docIds []uint32) ([]float64, error) {
+	res := make([]float64, len(docIds))
+	factors, err := index.functionFactors(m, docIds)
+	if err != nil {
+		return nil, err
+	}
+	for i, docId := range docIds {
+		if factors == nil {
+			res[i], _ = index.relevance(m, docId)
+		} else {
+			res[i] = factors[i].Relevance * factors[i].Decay * factors[i].Popularity
+		}
+	}
+	return res, nil
+}
+
+// decodeInt is the inverse of encodeInt, a missing value is 0.
+func decodeInt(b []byte) int64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b) ^ 1<<63)
+}
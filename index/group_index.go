@@ -0,0 +1,233 @@
+package index
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/mnhkahn/gods/xencoding"
+	"github.com/mnhkahn/gogogo/logger"
+	"github.com/vmihailenco/msgpack"
+	"github.com/willf/bitset"
+)
+
+// Fields of Param.CollapseBy, a tag prefix is CollapseByTag followed by the prefix,
+// e.g. "tag:series-".
+const (
+	CollapseByCategory = "category"
+	CollapseByLinkHost = "link_host"
+	CollapseByTag      = "tag:"
+)
+
+// groupsIndexName is the bucket of the group values of the documents, like DocValues. It's
+// derived from the documents and rebuilt on open if it's empty.
+var groupsIndexName = []byte("Groups")
+
+// groupFields are the fields of the group values, tags are the lowercased tags separated
+// by 0.
+var groupFields = []string{"category", "link_host", "tags"}
+
+// Group is the top hits of a group of Param.CollapseBy.
+type Group struct {
+	// Key is the value of the field, it's empty for a hit without a value, which is a
+	// group by itself.
+	Key string `json:"key"`
+	// Total is the number of hits of the group.
+	Total int    `json:"total"`
+	Hits  []*Hit `json:"hits"`
+}
+
+// group is a Group of docIds.
+type group struct {
+	key    string
+	total  int
+	docIds []uint32
+}
+
+// groupValues returns the group values of doc in the order of groupFields, an empty one is
+// nil.
+func groupValues(doc *Document) [][]byte {
+	values := make([][]byte, len(groupFields))
+	if c := categoryPath(doc.Category); c != "" {
+		values[0] = []byte(c)
+	}
+	if host := linkHost(doc.Link); host != "" {
+		values[1] = []byte(host)
+	}
+	if len(doc.Tags) > 0 {
+		tags := make([]string, 0, len(doc.Tags))
+		for _, tag := range doc.Tags {
+			tags = append(tags, strings.ToLower(tag))
+		}
+		values[2] = []byte(strings.Join(tags, "\x00"))
+	}
+	return values
+}
+
+// linkHost returns the lowercased host of link without www., or "" if it has none.
+func linkHost(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+func (index *Index) setGroupValuesTx(tx *bolt.Tx, docId uint32, doc *Document) error {
+	for i, v := range groupValues(doc) {
+		var err error
+		if v == nil {
+			err = index._index.DeleteTx(tx, groupsIndexName, docValueKey(groupFields[i], docId))
+		} else {
+			err = index._index.SetTx(tx, groupsIndexName, docValueKey(groupFields[i], docId), v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (index *Index) deleteGroupValuesTx(tx *bolt.Tx, docId uint32) error {
+	for _, field := range groupFields {
+		if err := index._index.DeleteTx(tx, groupsIndexName, docValueKey(field, docId)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateCollapseBy checks Param.CollapseBy.
+func validateCollapseBy(by string) error {
+	switch {
+	case by == CollapseByCategory, by == CollapseByLinkHost:
+	case strings.HasPrefix(by, CollapseByTag) && len(by) > len(CollapseByTag):
+	default:
+		return &ParamError{Name: "collapse_by", Reason: fmt.Sprintf("is %s, %s or %s followed by a tag prefix", CollapseByCategory, CollapseByLinkHost, CollapseByTag)}
+	}
+	return nil
+}
+
+// groupKeys returns the group of every docId by the field of Param.CollapseBy, "" if it
+// has none.
+func (index *Index) groupKeys(by string, docIds []uint32) ([]string, error) {
+	field, prefix := by, ""
+	if strings.HasPrefix(by, CollapseByTag) {
+		field, prefix = "tags", strings.ToLower(strings.TrimPrefix(by, CollapseByTag))
+	}
+
+	res := make([]string, len(docIds))
+	err := index._index.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(groupsIndexName)
+		for i, docId := range docIds {
+			v := b.Get(docValueKey(field, docId))
+			if v == nil {
+				continue
+			}
+			if field != "tags" {
+				res[i] = string(v)
+				continue
+			}
+			for _, tag := range strings.Split(string(v), "\x00") {
+				if strings.HasPrefix(tag, prefix) {
+					res[i] = tag
+					break
+				}
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+// collapse keeps the first of keys of every group of m by the field of by, and counts
+// the others in m.
+func (index *Index) collapse(m *matches, by string, keys []*sortKey) ([]*sortKey, error) {
+	docIds := make([]uint32, len(keys))
+	for i, k := range keys {
+		docIds[i] = k.docId
+	}
+	groups, err := index.groupKeys(by, docIds)
+	if err != nil {
+		return nil, err
+	}
+
+	m.groupOf = make(map[uint32]string)
+	m.collapsedOf = make(map[uint32]int)
+	first := make(map[string]uint32)
+	res := make([]*sortKey, 0, len(keys))
+	for i, k := range keys {
+		g := groups[i]
+		if g == "" {
+			res = append(res, k)
+			continue
+		}
+		if top, exists := first[g]; exists {
+			m.collapsedOf[top]++
+			continue
+		}
+		first[g] = k.docId
+		m.groupOf[k.docId] = g
+		res = append(res, k)
+	}
+	m.collapsed += len(keys) - len(res)
+	m.total -= len(keys) - len(res)
+	return res, nil
+}
+
+// groups returns the groups of keys by the field of by in the order of their first key,
+// with their first size docIds.
+func (index *Index) groups(by string, keys []*sortKey, size int) ([]*group, error) {
+	docIds := make([]uint32, len(keys))
+	for i, k := range keys {
+		docIds[i] = k.docId
+	}
+	groupKeys, err := index.groupKeys(by, docIds)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*group
+	byKey := make(map[string]*group)
+	for i, docId := range docIds {
+		key := groupKeys[i]
+		g, exists := byKey[key]
+		if !exists || key == "" {
+			g = &group{key: key}
+			res = append(res, g)
+			if key != "" {
+				byKey[key] = g
+			}
+		}
+		g.total++
+		if len(g.docIds) < size {
+			g.docIds = append(g.docIds, docId)
+		}
+	}
+	return res, nil
+}
+
+// buildGroupValues writes the group values of every live document if the bucket is empty,
+// e.g. the index was created before the group values were.
+func (index *Index) buildGroupValues() error {
+	if index._index.Len(groupsIndexName) > 0 || index.status.Len() == 0 {
+		return nil
+	}
+
+	logger.Infof("build group values of %d documents.", index.status.Len())
+	return index.writer.write(func(tx *bolt.Tx, status *bitset.BitSet) error {
+		return tx.Bucket(documentIndexName).ForEach(func(k, v []byte) error {
+			docId := xencoding.Bytes2Uint(k)
+			if !status.Test(uint(docId)) {
+				return nil
+			}
+			doc := new(Document)
+			if err := msgpack.Unmarshal(v, doc); err != nil {
+				logger.Warnf("group values of document %d: %v", docId, err)
+				return nil
+			}
+			return index.setGroupValuesTx(tx, docId, doc)
+		})
+	})
+}
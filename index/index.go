@@ -2,11 +2,13 @@ package index
 
 import (
 	"encoding/binary"
-	"sync"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/huichen/sego"
+	"github.com/mnhkahn/gods/xencoding"
 	"github.com/mnhkahn/gogogo/logger"
+	"github.com/willf/bitset"
 )
 
 var (
@@ -18,8 +20,54 @@ var (
 	fullTextIndexName = []byte("FullText")
 	tagIndexName      = []byte("Tags")
 	categoryIndexName = []byte("Category")
+
+	// indexNames is every bucket of an index, they are cleared by ClearAll.
+	indexNames = [][]byte{
+		documentIndexName,
+		statusIndexName,
+		pkIndexName,
+		titleIndexName,
+		briefIndexName,
+		fullTextIndexName,
+		tagIndexName,
+		categoryIndexName,
+	}
+
+	// searchModeKey is set in Meta to the SearchMode the terms of the index are segmented
+	// with, see loadSearchMode.
+	searchModeKey = []byte("search_mode")
 )
 
+// Options of an index.
+type Options struct {
+	// Dictionary is the sego dictionary files separated by comma.
+	Dictionary string
+	// SearchMode segments text into finer terms, see sego.SegmentsToSlice.
+	SearchMode bool
+	// MaxPageSize is the largest Param.Size.
+	MaxPageSize int
+	// RefreshInterval is how often the enqueued documents are indexed, 0 indexes them
+	// as soon as they are enqueued.
+	RefreshInterval time.Duration
+	// PVFlushInterval is how often the pv increments are written to the bolt file, 0
+	// writes them at once.
+	PVFlushInterval time.Duration
+	// Duplicates is what AddDocument does with a new pk that is a near duplicate, see
+	// DuplicatesAllow.
+	Duplicates string
+	// DuplicateDistance is the largest Hamming distance of the SimHash fingerprints of near
+	// duplicates, DefaultDuplicateDistance if 0.
+	DuplicateDistance int
+}
+
+// DefaultOptions is used by NewIndex.
+var DefaultOptions = Options{
+	Dictionary:      "./dictionary.txt",
+	MaxPageSize:     100,
+	RefreshInterval: time.Second,
+	PVFlushInterval: 5 * time.Second,
+}
+
 type Index struct {
 	_index *BTree
 	// 主键
@@ -30,17 +78,51 @@ type Index struct {
 	tag      *InvertIndex
 	category *InvertIndex
 	status   *Bitmap
+	// simHashes are the bands of the fingerprints of the full texts.
+	simHashes *InvertIndex
 
-	documentLock sync.Mutex
-	documents    *InvertIndex
+	documents *InvertIndex
 
-	segmenter sego.Segmenter
+	writer   *writer
+	queue    *queue
+	counters *counters
+
+	opts      Options
+	segmenter *sego.Segmenter
 }
 
+// NewIndex opens the index at path with DefaultOptions.
 func NewIndex(path string) (*Index, error) {
+	return NewIndexWithOptions(path, DefaultOptions)
+}
+
+// NewIndexWithOptions opens the index at path, the bolt file is created if it doesn't exist.
+func NewIndexWithOptions(path string, opts Options) (*Index, error) {
 	var err error
 
 	index := new(Index)
+	defer func() {
+		// don't leak the bolt file lock if the index is half opened.
+		if err != nil && index._index != nil {
+			if index.writer != nil {
+				index.writer.close()
+			}
+			index._index.Close()
+		}
+	}()
+
+	if opts.MaxPageSize <= 0 {
+		opts.MaxPageSize = DefaultOptions.MaxPageSize
+	}
+	if err = checkDuplicateOptions(&opts); err != nil {
+		return index, err
+	}
+	index.opts = opts
+
+	index.segmenter, err = loadSegmenter(opts.Dictionary)
+	if err != nil {
+		return index, err
+	}
 
 	index._index, err = NewBTree(path)
 	if err != nil {
@@ -82,16 +164,138 @@ func NewIndex(path string) (*Index, error) {
 		return index, err
 	}
 
+	for i, ii := range []*InvertIndex{index.title, index.brief, index.fullText} {
+		err = ii.withReverse(reverseIndexNames[i])
+		if err != nil {
+			return index, err
+		}
+	}
+
 	index.documents, err = NewInvertIndex(documentIndexName, index._index)
 	if err != nil {
 		return index, err
 	}
 
-	index.segmenter.LoadDictionary("./dictionary.txt")
+	err = index._index.AddBTree(docValuesIndexName)
+	if err != nil {
+		return index, err
+	}
+
+	index.simHashes, err = NewInvertIndex(simHashIndexName, index._index)
+	if err != nil {
+		return index, err
+	}
+
+	err = index._index.AddBTree(groupsIndexName)
+	if err != nil {
+		return index, err
+	}
+
+	err = index._index.AddBTree(mergedIndexName)
+	if err != nil {
+		return index, err
+	}
+
+	err = index.recoverStatus()
+	if err != nil {
+		return index, err
+	}
+
+	index.writer = newWriter(index)
+
+	err = index._index.AddBTree(metaIndexName)
+	if err != nil {
+		return index, err
+	}
+
+	err = index.loadSearchMode()
+	if err != nil {
+		return index, err
+	}
+
+	err = index.buildDocValues()
+	if err != nil {
+		return index, err
+	}
+
+	err = index.buildSimHashes()
+	if err != nil {
+		return index, err
+	}
+
+	err = index.buildGroupValues()
+	if err != nil {
+		return index, err
+	}
+
+	err = index.buildReverseTerms()
+	if err != nil {
+		return index, err
+	}
+
+	err = index.migrateCategoryPaths()
+	if err != nil {
+		return index, err
+	}
+
+	index.queue, err = newQueue(index, path+".wal", opts.RefreshInterval)
+	if err != nil {
+		return index, err
+	}
+
+	index.counters = newCounters(index, opts.PVFlushInterval)
 
 	return index, err
 }
 
+// loadSearchMode keeps the SearchMode of the index in Meta. The terms of an index are
+// segmented in the mode it's created with, so its stored mode wins over Options.SearchMode,
+// a new mode is applied by reindexing into a new index.
+func (index *Index) loadSearchMode() error {
+	value, exists, err := index._index.Search(metaIndexName, searchModeKey)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		mode := []byte{0}
+		if index.opts.SearchMode {
+			mode[0] = 1
+		}
+		return index._index.Set(metaIndexName, searchModeKey, mode)
+	}
+
+	stored := len(value) > 0 && value[0] == 1
+	if stored != index.opts.SearchMode {
+		logger.Warnf("index is segmented with search mode %v, search mode %v is ignored.", stored, index.opts.SearchMode)
+		index.opts.SearchMode = stored
+	}
+	return nil
+}
+
+// recoverStatus rebuilds the status bitmap from the documents bucket if they disagree,
+// e.g. the process was killed between setting a status bit and committing the bitmap.
+func (index *Index) recoverStatus() error {
+	live := bitset.New(1)
+	err := index._index.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(documentIndexName).ForEach(func(k, v []byte) error {
+			live.Set(uint(xencoding.Bytes2Uint(k)))
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if index.status.Equal(live) {
+		return nil
+	}
+
+	logger.Warnf("status has %d documents, documents bucket has %d, rebuild status.", index.status.Len(), live.Count())
+	return index.status.Reset(live)
+}
+
+// GetDB returns the bolt db of the index. It's closed and replaced by Compact, so the db
+// mustn't be kept or used while a Compact may run.
 func (index *Index) GetDB() *bolt.DB {
 	return index._index.GetDB()
 }
@@ -106,32 +310,76 @@ func (index *Index) extendMaybe(docId uint32) error {
 func (index *Index) ClearAll() error {
 	logger.Info("index clear all.")
 
-	index.pk.ClearAll()
-	index.title.ClearAll()
-	index.brief.ClearAll()
-	index.fullText.ClearAll()
-	index.tag.ClearAll()
-	index.category.ClearAll()
-	index.status.ClearAll()
-	index.documents.ClearAll()
-
+	err := index.writer.write(func(tx *bolt.Tx, status *bitset.BitSet) error {
+		names := append(append(indexNames, docValuesIndexName, simHashIndexName, groupsIndexName, mergedIndexName), reverseIndexNames...)
+		for _, name := range names {
+			logger.Info("clear bucket", string(name))
+			if err := tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		status.ClearAll()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	index.counters.reset()
 	return nil
 }
 
+// Close indexes the enqueued documents, commits the queued writes, flushes the status
+// bitmap and closes the bolt file.
 func (index *Index) Close() error {
-	return index._index.Close()
+	if index._index == nil {
+		return nil
+	}
+	if index.queue != nil {
+		if err := index.queue.close(); err != nil {
+			logger.Warn("close wal", err)
+		}
+	}
+	if index.counters != nil {
+		if err := index.counters.close(); err != nil {
+			logger.Warn("flush pv", err)
+		}
+	}
+	if index.writer != nil {
+		index.writer.close()
+	}
+
+	var err error
+	if index.status != nil {
+		err = index.status.Close()
+		if err != nil {
+			logger.Warn("flush status", err)
+		}
+	}
+
+	cerr := index._index.Close()
+	if cerr != nil {
+		return cerr
+	}
+	return err
 }
 
 func (index *Index) Buckets() (map[string]int, error) {
 	res := make(map[string]int)
 
-	err := index.GetDB().View(func(tx *bolt.Tx) error {
+	err := index._index.View(func(tx *bolt.Tx) error {
 		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
 			switch string(name) {
 			case string(documentIndexName):
-				res[string(name)] = index.documents.Len()
+				// not index.documents.Len(), a nested View waits behind a Compact.
+				res[string(name)] = bucket.Stats().KeyN
 			case string(statusIndexName):
 				res[string(name)] = int(index.status.Len())
+			case string(metaIndexName):
+			case string(docValuesIndexName), string(groupsIndexName), string(mergedIndexName), string(titleReverseIndexName), string(briefReverseIndexName), string(fullTextReverseIndexName):
+				res[string(name)] = bucket.Stats().KeyN
 			default:
 				l := 0
 				bucket.ForEach(func(k, v []byte) error {
@@ -2,9 +2,22 @@
 package index
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/boltdb/bolt"
+	"github.com/mnhkahn/gods/xencoding"
 	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack"
+	"github.com/willf/bitset"
 )
 
 func TestIndexTitle(t *testing.T) {
@@ -180,7 +193,8 @@ func TestIndex_SortDocIds(t *testing.T) {
 	})
 	assert.Nil(t, err)
 	resPks := toPks(res)
-	assert.Equal(t, []string{"3", "2", "1"}, resPks)
+	// the ties are broken by pk in the other direction.
+	assert.Equal(t, []string{"3", "1", "2"}, resPks)
 	assert.Equal(t, 3, cnt)
 }
 
@@ -231,21 +245,63 @@ func TestIndex_PageSize(t *testing.T) {
 	for _, rrr := range res {
 		resPks = append(resPks, rrr.PK)
 	}
-	assert.Equal(t, []string{"3", "2", "1"}, resPks)
+	// the ties are broken by pk in the other direction.
+	assert.Equal(t, []string{"3", "1", "2"}, resPks)
 	assert.Equal(t, 3, cnt)
 	assert.Equal(t, 3, len(res))
 
+	cnt, res, err = index.Search(&Param{
+		Category: "golang",
+		Sort:     Sorter{Asc: ASC},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"2", "1", "3"}, toPks(res))
+
 	cnt, res, err = index.Search(&Param{
 		Category: "golang",
 		Offset:   1,
 		Size:     1,
 	})
 	assert.Nil(t, err)
-	assert.Equal(t, "2", res[0].PK)
+	assert.Equal(t, "1", res[0].PK)
 	assert.Equal(t, 3, cnt)
 	assert.Equal(t, 1, len(res))
 }
 
+func TestSearchAllUncapped(t *testing.T) {
+	b := &Bitmap{data: bitset.New(1)}
+	n := 0x80000 + 10
+	for i := 1; i <= n; i++ {
+		b.data.Set(uint(i))
+	}
+	all := b.All()
+	assert.Equal(t, n, len(all))
+	assert.Equal(t, uint32(1), all[0])
+	assert.Equal(t, uint32(n), all[n-1])
+
+	index, err := NewIndex("/tmp/a.db")
+	defer index.Close()
+	assert.Nil(t, err)
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+	docs := make([]*Document, 0, 12)
+	for i := 0; i < 12; i++ {
+		docs = append(docs, &Document{PK: fmt.Sprint(i), Title: "golang"})
+	}
+	assert.Nil(t, index.AddDocuments(docs...))
+
+	// a page is Options.MaxPageSize documents by default.
+	cnt, res, err := index.Search(&Param{Query: "*"})
+	assert.Nil(t, err)
+	assert.Equal(t, 12, cnt)
+	assert.Equal(t, 12, len(res))
+	cnt, res, err = index.Search(&Param{TagsNone: []string{"rust"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 12, cnt)
+	assert.Equal(t, 12, len(res))
+}
+
 func TestAddTwoTimes(t *testing.T) {
 	index, err := NewIndex("/tmp/a.db")
 	defer index.Close()
@@ -319,3 +375,1347 @@ func TestSort(t *testing.T) {
 	pks = toPks(res)
 	assert.Equal(t, []string{"b", "a", "c"}, pks)
 }
+
+func TestRecoverStatus(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	assert.Nil(t, err)
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+
+	err = index.AddDocument(&Document{PK: "a", Title: "Golang——json数据处理"})
+	assert.Nil(t, err)
+	err = index.AddDocument(&Document{PK: "b", Title: "Golang——json数据处理"})
+	assert.Nil(t, err)
+
+	// crash after the status bit of a document is cleared in memory and committed,
+	// but before the document is removed.
+	index.status.SetTo(1, false)
+	assert.Nil(t, index.Commit())
+	assert.Nil(t, index.Close())
+
+	index, err = NewIndex("/tmp/a.db")
+	defer index.Close()
+	assert.Nil(t, err)
+
+	cnt, res, err := index.SearchAll(&Param{Size: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, cnt)
+	assert.ElementsMatch(t, []string{"a", "b"}, toPks(res))
+}
+
+func TestCloseFlushStatus(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	assert.Nil(t, err)
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+
+	err = index.AddDocument(&Document{PK: "a", Title: "Golang——json数据处理"})
+	assert.Nil(t, err)
+	assert.Nil(t, index.Close())
+
+	index, err = NewIndex("/tmp/a.db")
+	defer index.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), index.status.Len())
+}
+
+func TestAddDocumentsAtomic(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	defer index.Close()
+	assert.Nil(t, err)
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+
+	// the tag is longer than the max key size of bolt.
+	err = index.AddDocuments(&Document{
+		PK:    "a",
+		Title: "Golang——json数据处理",
+	}, &Document{
+		PK:   "b",
+		Tags: []string{strings.Repeat("golang", 10000)},
+	})
+	assert.NotNil(t, err)
+
+	cnt, res, err := index.Search(&Param{Query: "golang"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, cnt)
+	assert.Equal(t, 0, len(res))
+	assert.Equal(t, uint32(0), index.status.Len())
+	assert.Equal(t, 0, index.pk.Len())
+	assert.Equal(t, 0, index.documents.Len())
+}
+
+func TestAddDocumentRemoveOldTerms(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	defer index.Close()
+	assert.Nil(t, err)
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+
+	err = index.AddDocument(&Document{
+		PK:    "a",
+		Title: "Golang——json数据处理",
+		Tags:  []string{"Golang"},
+	})
+	assert.Nil(t, err)
+	err = index.AddDocument(&Document{
+		PK:    "a",
+		Title: "Unicode的介绍",
+		Tags:  []string{"Unicode"},
+	})
+	assert.Nil(t, err)
+
+	cnt, _, err := index.Search(&Param{Query: "golang"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, cnt)
+
+	cnt, _, err = index.Search(&Param{Tags: []string{"golang"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, cnt)
+
+	cnt, res, err := index.Search(&Param{Query: "unicode"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, cnt)
+	assert.Equal(t, "Unicode的介绍", res[0].Title)
+}
+
+func TestConcurrentAddDocument(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	defer index.Close()
+	assert.Nil(t, err)
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+
+	const workers, docs = 8, 30
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < docs; i++ {
+				err := index.AddDocument(&Document{
+					PK:    fmt.Sprintf("%d-%d", w, i),
+					Title: "Golang——json数据处理",
+					Tags:  []string{"Golang", fmt.Sprintf("worker%d", w)},
+				})
+				assert.Nil(t, err)
+			}
+		}(w)
+	}
+	// re-add the same documents at the same time, they must keep their docIds.
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < docs; i++ {
+				err := index.AddDocument(&Document{
+					PK:    fmt.Sprintf("%d-%d", w, i),
+					Title: "Golang——json数据处理",
+					Tags:  []string{"Golang", fmt.Sprintf("worker%d", w)},
+				})
+				assert.Nil(t, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	assert.Equal(t, uint32(workers*docs), index.status.Len())
+
+	all, err := index.SearchAllDocIds(true)
+	assert.Nil(t, err)
+	for _, field := range []*InvertIndex{index.title, index.tag} {
+		docIds, exists, err := field.SearchBytesUints([]byte("golang"))
+		assert.Nil(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, all, docIds)
+	}
+
+	seen := make(map[uint32]bool)
+	for w := 0; w < workers; w++ {
+		docIds, exists, err := index.tag.SearchBytesUints([]byte(fmt.Sprintf("worker%d", w)))
+		assert.Nil(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, docs, len(docIds))
+
+		for i := 0; i < docs; i++ {
+			pkDocIds, err := index.SearchPks(fmt.Sprintf("%d-%d", w, i))
+			assert.Nil(t, err)
+			assert.Equal(t, 1, len(pkDocIds))
+			assert.False(t, seen[pkDocIds[0]])
+			seen[pkDocIds[0]] = true
+		}
+	}
+}
+
+func TestEnqueue(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	defer index.Close()
+	assert.Nil(t, err)
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err = index.Enqueue(&Document{PK: fmt.Sprint(i), Title: "Golang——json数据处理"})
+		assert.Nil(t, err)
+	}
+	_, err = index.Enqueue(&Document{})
+	assert.NotNil(t, err)
+
+	assert.Nil(t, index.Refresh())
+	assert.Equal(t, 0, index.Pending())
+
+	cnt, _, err := index.SearchAll(&Param{Size: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 10, cnt)
+}
+
+func TestWALReplay(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	assert.Nil(t, err)
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+	seq, err := index.Enqueue(&Document{PK: "a", Title: "Golang——json数据处理"})
+	assert.Nil(t, err)
+	assert.Nil(t, index.Close())
+
+	// crash after b and c are written to the wal, in the middle of writing d, the length
+	// of the torn header is far beyond the file.
+	w, entries, err := openWAL("/tmp/a.db.wal")
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+	assert.Nil(t, w.append(&walEntry{Seq: seq + 1, Doc: &Document{PK: "b", Title: "Golang——json数据处理"}}))
+	assert.Nil(t, w.append(&walEntry{Seq: seq + 2, Doc: &Document{PK: "c", Title: "Golang——json数据处理"}}))
+	_, err = w.file.Write([]byte{0xff, 0xff, 0xff, 0xf0, 0, 0, 0, 0, 1, 2})
+	assert.Nil(t, err)
+	assert.Nil(t, w.close())
+
+	index, err = NewIndex("/tmp/a.db")
+	defer index.Close()
+	assert.Nil(t, err)
+	assert.Nil(t, index.Refresh())
+
+	cnt, res, err := index.SearchAll(&Param{Size: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, cnt)
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, toPks(res))
+
+	next, err := index.Enqueue(&Document{PK: "d", Title: "Golang——json数据处理"})
+	assert.Nil(t, err)
+	assert.Equal(t, seq+3, next)
+}
+
+func TestRefreshError(t *testing.T) {
+	opts := DefaultOptions
+	opts.RefreshInterval = 0
+	index, err := NewIndexWithOptions("/tmp/a.db", opts)
+	assert.Nil(t, err)
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+
+	// the documents can't be written, Refresh returns instead of waiting for them.
+	index.writer.close()
+	_, err = index.Enqueue(&Document{PK: "a", Title: "Golang——json数据处理"})
+	assert.Nil(t, err)
+	done := make(chan error, 1)
+	go func() { done <- index.Refresh() }()
+	select {
+	case err = <-done:
+		assert.Equal(t, ErrIndexClosed, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("refresh hangs")
+	}
+	assert.Equal(t, 1, index.Pending())
+	assert.Nil(t, index.Close())
+
+	index, err = NewIndexWithOptions("/tmp/a.db", opts)
+	defer index.Close()
+	assert.Nil(t, err)
+	assert.Nil(t, index.Refresh())
+	cnt, _, err := index.SearchAll(&Param{Size: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, cnt)
+}
+
+func TestSearchModeStored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peanut-index")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.db")
+
+	opts := DefaultOptions
+	opts.SearchMode = true
+	index, err := NewIndexWithOptions(path, opts)
+	assert.Nil(t, err)
+	assert.Nil(t, index.Close())
+
+	// the index keeps the mode it's created with.
+	opts.SearchMode = false
+	index, err = NewIndexWithOptions(path, opts)
+	assert.Nil(t, err)
+	defer index.Close()
+	assert.True(t, index.opts.SearchMode)
+	value, _, err := index._index.Search(metaIndexName, searchModeKey)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1}, value)
+}
+
+func TestWALCompact(t *testing.T) {
+	os.Remove("/tmp/b.wal")
+	w, _, err := openWAL("/tmp/b.wal")
+	assert.Nil(t, err)
+	for i, pk := range []string{"a", "b", "c"} {
+		assert.Nil(t, w.append(&walEntry{Seq: uint64(i + 1), Doc: &Document{PK: pk, Title: "Golang——json数据处理"}}))
+	}
+
+	q := &queue{wal: w}
+	_, q.pending, err = openWAL("/tmp/b.wal")
+	assert.Nil(t, err)
+	q.compactLocked()
+	info, err := os.Stat("/tmp/b.wal")
+	assert.Nil(t, err)
+	assert.Equal(t, info.Size(), w.size)
+
+	// the applied a and b are dropped, d is appended after the pending c.
+	q.pending = q.pending[2:]
+	q.compactLocked()
+	assert.Nil(t, w.append(&walEntry{Seq: 4, Doc: &Document{PK: "d", Title: "Golang——json数据处理"}}))
+	assert.Nil(t, w.close())
+
+	w, entries, err := openWAL("/tmp/b.wal")
+	assert.Nil(t, err)
+	defer w.close()
+	pks := []string{}
+	for _, e := range entries {
+		pks = append(pks, e.Doc.PK)
+	}
+	assert.Equal(t, []string{"c", "d"}, pks)
+}
+
+func TestBackupRestore(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	assert.Nil(t, err)
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+	err = index.AddDocuments(&Document{PK: "a", Title: "Golang——json数据处理"}, &Document{PK: "b", Title: "Golang——json数据处理"})
+	assert.Nil(t, err)
+
+	buf := new(bytes.Buffer)
+	n, err := index.Backup(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+	assert.Nil(t, index.Close())
+
+	os.Remove("/tmp/b.db")
+	err = Restore("/tmp/b.db", strings.NewReader("not a bolt file"))
+	assert.IsType(t, &SnapshotError{}, err)
+	_, err = os.Stat("/tmp/b.db")
+	assert.True(t, os.IsNotExist(err))
+	spooled, err := filepath.Glob("/tmp/.restore-*")
+	assert.Nil(t, err)
+	assert.Empty(t, spooled)
+
+	snapshot := buf.Bytes()
+	err = Restore("/tmp/b.db", bytes.NewReader(snapshot))
+	assert.Nil(t, err)
+	fi, err := os.Stat("/tmp/b.db")
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+
+	// the restored file keeps the mode of the replaced one.
+	assert.Nil(t, os.Chmod("/tmp/b.db", 0640))
+	err = Restore("/tmp/b.db", bytes.NewReader(snapshot))
+	assert.Nil(t, err)
+	fi, err = os.Stat("/tmp/b.db")
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+
+	index, err = NewIndex("/tmp/b.db")
+	defer index.Close()
+	assert.Nil(t, err)
+
+	cnt, res, err := index.SearchAll(&Param{Size: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, cnt)
+	assert.ElementsMatch(t, []string{"a", "b"}, toPks(res))
+}
+
+func TestExportImport(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	assert.Nil(t, err)
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+	err = index.AddDocuments(&Document{PK: "a", Title: "Golang——json数据处理", Tags: []string{"go"}}, &Document{PK: "b", Title: "Golang——json数据处理"})
+	assert.Nil(t, err)
+
+	buf := new(bytes.Buffer)
+	n, err := index.Export(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 2, strings.Count(buf.String(), "\n"))
+	assert.Nil(t, index.Close())
+
+	os.Remove("/tmp/b.db")
+	os.Remove("/tmp/b.db.wal")
+	index, err = NewIndex("/tmp/b.db")
+	defer index.Close()
+	assert.Nil(t, err)
+
+	n, err = index.Import(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	cnt, res, err := index.SearchAll(&Param{Size: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, cnt)
+	assert.ElementsMatch(t, []string{"a", "b"}, toPks(res))
+
+	n, err = index.Import(strings.NewReader("{\"pk\": \"c\"}\n\nnot json\n{\"pk\": \"d\"}\n"))
+	assert.Equal(t, 1, n)
+	lerr, ok := err.(*LineError)
+	assert.True(t, ok)
+	assert.Equal(t, 3, lerr.Line)
+}
+
+func TestCheckRepair(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	defer index.Close()
+	assert.Nil(t, err)
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+	err = index.AddDocuments(&Document{PK: "a", Title: "golang"}, &Document{PK: "b", Title: "golang"}, &Document{PK: "c", Title: "json"})
+	assert.Nil(t, err)
+
+	report, err := index.Check()
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 3, report.Documents)
+
+	blob, err := msgpack.Marshal(&Document{PK: "a", Title: "golang"})
+	assert.Nil(t, err)
+	set := func(tx *bolt.Tx, name []byte, term string, docIds ...uint32) {
+		index._index.SetTx(tx, name, []byte(term), xencoding.Uints2Bytes(docIds))
+	}
+	err = index.writer.write(func(tx *bolt.Tx, status *bitset.BitSet) error {
+		// a is stored twice, with docId 0 and 12.
+		status.Set(12)
+		index.documents.SetUIntBytesTx(tx, 12, blob)
+		set(tx, pkIndexName, "a", 0, 12)
+		// b's pk posting has a's docId.
+		set(tx, pkIndexName, "b", 0, 1)
+		// an unsorted posting list.
+		set(tx, titleIndexName, "golang", 12, 1, 0)
+		// an undecodable document and a bit without document, with the values of a document.
+		status.Set(10)
+		index.documents.SetUIntBytesTx(tx, 10, []byte{0xc1})
+		index.setDocValuesTx(tx, 10, &Document{PK: "x", PV: 1})
+		status.Set(11)
+		index.setGroupValuesTx(tx, 11, &Document{PK: "y", Category: "go"})
+		return nil
+	})
+	assert.Nil(t, err)
+
+	report, err = index.Check()
+	assert.Nil(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, []uint32{10}, report.UndecodableDocuments)
+	assert.Equal(t, []uint32{11}, report.MissingDocuments)
+	assert.Equal(t, []*DuplicatePK{{PK: "a", DocIds: []uint32{0, 12}}}, report.DuplicatePKs)
+	assert.Equal(t, []*PostingIssue{{Field: "PK", Term: "b", DocIds: []uint32{0}}}, report.OrphanPostings)
+	assert.Equal(t, []*PostingIssue{{Field: "Title", Term: "golang"}}, report.UnsortedPostings)
+
+	report, err = index.Repair()
+	assert.Nil(t, err)
+	assert.Equal(t, 5, report.Problems())
+	assert.Equal(t, 3, report.Documents)
+
+	report, err = index.Check()
+	assert.Nil(t, err)
+	assert.True(t, report.OK(), "%+v", report)
+
+	// the values of the removed docIds are removed, the kept a has its values.
+	err = index._index.View(func(tx *bolt.Tx) error {
+		values, groups := tx.Bucket(docValuesIndexName), tx.Bucket(groupsIndexName)
+		assert.Nil(t, values.Get(docValueKey("pv", 0)))
+		assert.Nil(t, values.Get(docValueKey("pv", 10)))
+		assert.NotNil(t, values.Get(docValueKey("pv", 12)))
+		assert.Nil(t, groups.Get(docValueKey("category", 11)))
+		return nil
+	})
+	assert.Nil(t, err)
+
+	cnt, res, err := index.Search(&Param{PKs: []string{"a", "b"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, cnt)
+	assert.ElementsMatch(t, []string{"a", "b"}, toPks(res))
+}
+
+func TestCompact(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	defer index.Close()
+	assert.Nil(t, err)
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+
+	docs := make([]*Document, 0, 200)
+	for i := 0; i < 200; i++ {
+		docs = append(docs, &Document{PK: fmt.Sprint(i), Title: "golang json", FullText: strings.Repeat(fmt.Sprintf("word%d ", i), 200)})
+	}
+	err = index.AddDocuments(docs...)
+	assert.Nil(t, err)
+
+	// the documents 100+ are deleted.
+	err = index.writer.write(func(tx *bolt.Tx, status *bitset.BitSet) error {
+		for i := uint(100); i < 200; i++ {
+			status.Clear(i)
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+
+	report, err := index.Compact()
+	assert.Nil(t, err)
+	assert.Equal(t, 100, report.RemovedDocuments)
+	assert.True(t, report.RemovedPostings >= 100*3)
+	assert.True(t, report.DroppedTerms >= 100)
+	assert.True(t, report.SizeAfter < report.SizeBefore, "%+v", report)
+
+	check, err := index.Check()
+	assert.Nil(t, err)
+	assert.True(t, check.OK(), "%+v", check)
+
+	err = index.AddDocument(&Document{PK: "new", Title: "golang"})
+	assert.Nil(t, err)
+	cnt, _, err := index.Search(&Param{Query: "golang", Size: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 101, cnt)
+
+	// the bucket stats don't nest a read lock, it would wait behind a Compact.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			buckets, err := index.Buckets()
+			assert.Nil(t, err)
+			assert.Equal(t, 101, buckets[string(documentIndexName)])
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 3; i++ {
+			_, _, err := index._index.Compact()
+			assert.Nil(t, err)
+		}
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("buckets and compact deadlocked")
+	}
+}
+
+func TestDeleteDocument(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	defer index.Close()
+	assert.Nil(t, err)
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+	err = index.AddDocuments(&Document{PK: "a", Title: "golang", Tags: []string{"go"}}, &Document{PK: "b", Title: "golang"})
+	assert.Nil(t, err)
+
+	assert.Nil(t, index.DeleteDocument("a"))
+	assert.Equal(t, ErrDocumentNotFound, index.DeleteDocument("a"))
+
+	cnt, res, err := index.Search(&Param{Query: "golang", Size: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, cnt)
+	assert.Equal(t, []string{"b"}, toPks(res))
+
+	cnt, _, err = index.Search(&Param{Tags: []string{"go"}, Size: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, cnt)
+
+	report, err := index.Check()
+	assert.Nil(t, err)
+	assert.True(t, report.OK(), "%+v", report)
+
+	// the docId of a is reused.
+	err = index.AddDocument(&Document{PK: "c", Title: "golang"})
+	assert.Nil(t, err)
+	docIds, err := index.SearchPks("c")
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{0}, docIds)
+}
+
+func TestTerms(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	defer index.Close()
+	assert.Nil(t, err)
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+	err = index.AddDocuments(
+		&Document{PK: "a", Tags: []string{"go", "golang", "json"}},
+		&Document{PK: "b", Tags: []string{"go", "gopher"}},
+		&Document{PK: "c", Tags: []string{"go"}},
+	)
+	assert.Nil(t, err)
+	assert.Nil(t, index.DeleteDocument("c"))
+
+	terms, err := index.Terms("tags", "go", "", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []*TermStat{{Term: "go", DocFreq: 2, Postings: 2}, {Term: "golang", DocFreq: 1, Postings: 1}}, terms)
+
+	terms, err = index.Terms("tags", "go", "golang", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []*TermStat{{Term: "gopher", DocFreq: 1, Postings: 1}}, terms)
+
+	terms, err = index.Terms("tags", "", "", 0)
+	assert.Nil(t, err)
+	assert.Len(t, terms, 4)
+
+	info, err := index.Term("tags", "go")
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{0, 1}, info.DocIds)
+	assert.Equal(t, []string{"a", "b"}, info.PKs)
+
+	_, err = index.Term("tags", "rust")
+	assert.Equal(t, ErrTermNotFound, err)
+	_, err = index.Terms("foo", "", "", 0)
+	assert.IsType(t, &FieldError{}, err)
+
+	// every field maps to its own bucket.
+	buckets := map[string]string{}
+	for _, name := range Fields {
+		ii, err := index.field(name)
+		assert.Nil(t, err)
+		buckets[name] = string(ii.btname)
+	}
+	assert.Equal(t, map[string]string{"pk": "PK", "title": "Title", "brief": "Brief", "full_text": "FullText", "tags": "Tags", "category": "Category"}, buckets)
+}
+
+func TestQueryExplain(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	defer index.Close()
+	assert.Nil(t, err)
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+	err = index.AddDocuments(
+		&Document{PK: "a", Title: "golang", Brief: "json", Tags: []string{"go"}, Category: "code"},
+		&Document{PK: "b", Title: "json", Brief: "golang", Tags: []string{"go"}, Category: "code"},
+		&Document{PK: "c", Brief: "golang", Tags: []string{"rust"}, Category: "code"},
+	)
+	assert.Nil(t, err)
+
+	res, err := index.Query(&Param{Query: "golang", Tags: []string{"go"}, Sort: Sorter{Field: SortByScore}, Explain: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, res.Total)
+	assert.Len(t, res.Hits, 2)
+
+	// a title match scores more than a brief match.
+	assert.Equal(t, "a", res.Hits[0].PK)
+	assert.Equal(t, "b", res.Hits[1].PK)
+	assert.True(t, res.Hits[0].Score > res.Hits[1].Score)
+
+	e := res.Hits[0].Explanation
+	assert.Equal(t, []string{"golang"}, e.Matches["title"])
+	assert.Equal(t, []string{"go"}, e.Matches["tags"])
+	assert.Equal(t, []string{"tags in [go]"}, e.Filters)
+	assert.Len(t, e.Scores, 1)
+	assert.Equal(t, 1, e.Scores[0].DocFreq)
+	assert.Equal(t, 2, res.Hits[1].Explanation.Scores[0].DocFreq)
+	assert.Equal(t, []string{"golang"}, res.Hits[1].Explanation.Matches["brief"])
+
+	ops := make([]string, 0, len(res.Trace))
+	for _, step := range res.Trace {
+		ops = append(ops, step.Op)
+	}
+	assert.Equal(t, []string{"term", "term", "or", "tags", "and", "sort", "page"}, ops)
+	assert.Equal(t, "score desc", res.Trace[5].Detail)
+
+	res, err = index.Query(&Param{Query: "golang"})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, res.Total)
+	assert.Nil(t, res.Trace)
+	assert.Nil(t, res.Hits[0].Explanation)
+}
+
+func TestSearchAfter(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	defer index.Close()
+	assert.Nil(t, err)
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+	for i := 0; i < 25; i++ {
+		err = index.AddDocument(&Document{PK: fmt.Sprintf("%02d", i), Category: "golang", PubDate: int64(i / 2)})
+		assert.Nil(t, err)
+	}
+
+	cnt, res, err := index.SearchAll(&Param{Offset: 20})
+	assert.Nil(t, err)
+	assert.Equal(t, 25, cnt)
+	assert.Len(t, res, 5)
+
+	_, _, err = index.Search(&Param{Query: "*", Size: 101})
+	assert.IsType(t, &ParamError{}, err)
+
+	var pks []string
+	param := &Param{Category: "golang", Size: 10}
+	for {
+		r, err := index.Query(param)
+		assert.Nil(t, err)
+		assert.Equal(t, 25, r.Total)
+		for _, hit := range r.Hits {
+			pks = append(pks, hit.PK)
+		}
+		if r.Next == "" {
+			break
+		}
+		param.SearchAfter, err = ParseCursor(r.Next)
+		assert.Nil(t, err)
+	}
+	_, all, err := index.Search(&Param{Category: "golang", Size: 25})
+	assert.Nil(t, err)
+	assert.Equal(t, toPks(all), pks)
+
+	_, err = ParseCursor("!")
+	assert.IsType(t, &ParamError{}, err)
+	param.Sort = Sorter{Field: SortByScore}
+	_, err = index.Query(param)
+	assert.IsType(t, &ParamError{}, err)
+}
+
+func TestSortBy(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	defer index.Close()
+	assert.Nil(t, err)
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+	err = index.AddDocuments(
+		&Document{PK: "a", Title: "Beta", Category: "go", PubDate: 2, PV: 1},
+		&Document{PK: "b", Title: "alpha", Category: "go", PubDate: 2, PV: 5},
+		&Document{PK: "c", Category: "go", PubDate: 1, PV: 5},
+		&Document{PK: "d", Title: "gamma", Category: "go", PV: 9},
+	)
+	assert.Nil(t, err)
+
+	clauses, err := ParseSort("pub_date:desc,pv:asc")
+	assert.Nil(t, err)
+	_, res, err := index.Search(&Param{Category: "go", SortBy: clauses})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b", "c", "d"}, toPks(res))
+
+	clauses, err = ParseSort("title:asc")
+	assert.Nil(t, err)
+	_, res, err = index.Search(&Param{Category: "go", SortBy: clauses})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b", "a", "d", "c"}, toPks(res))
+
+	clauses, err = ParseSort("title:asc:first")
+	assert.Nil(t, err)
+	_, res, err = index.Search(&Param{Category: "go", SortBy: clauses})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c", "b", "a", "d"}, toPks(res))
+
+	_, err = ParseSort("link")
+	assert.IsType(t, &ParamError{}, err)
+	_, err = ParseSort("pv:up")
+	assert.IsType(t, &ParamError{}, err)
+	_, _, err = index.Search(&Param{Category: "go", SortBy: []SortClause{{Field: "pv", Missing: "middle"}}})
+	assert.IsType(t, &ParamError{}, err)
+
+	// the doc values are rebuilt if they're lost.
+	err = index.GetDB().Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(docValuesIndexName); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(docValuesIndexName)
+		return err
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, index.buildDocValues())
+	_, res, err = index.Search(&Param{Category: "go", SortBy: []SortClause{{Field: "pv"}, {Field: "pk"}}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"d", "c", "b", "a"}, toPks(res))
+}
+
+func TestFunctionScore(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	defer index.Close()
+	assert.Nil(t, err)
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+	now := time.Now().Unix()
+	day := int64(24 * time.Hour / time.Second)
+	err = index.AddDocuments(
+		&Document{PK: "old", Title: "golang", PubDate: now - 30*day, PV: 1000},
+		&Document{PK: "new", Title: "golang", PubDate: now - day, PV: 10},
+		&Document{PK: "popular", Title: "golang", PubDate: now - day, PV: 500},
+	)
+	assert.Nil(t, err)
+
+	decay := &Decay{Func: DecayGauss, Scale: 7 * 24 * time.Hour}
+	res, err := index.Query(&Param{Query: "golang", FunctionScore: &FunctionScore{Decay: decay}})
+	assert.Nil(t, err)
+	assert.Equal(t, "old", res.Hits[2].PK)
+	assert.True(t, res.Hits[2].Score < res.Hits[0].Score/100)
+
+	res, err = index.Query(&Param{Query: "golang", FunctionScore: &FunctionScore{Decay: decay, PVFactor: 0.1}, Explain: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"popular", "new", "old"}, []string{res.Hits[0].PK, res.Hits[1].PK, res.Hits[2].PK})
+	f := res.Hits[0].Explanation.Function
+	assert.InDelta(t, res.Hits[0].Score, f.Relevance*f.Decay*f.Popularity, 1e-9)
+	assert.InDelta(t, 1+math.Log1p(50), f.Popularity, 1e-9)
+
+	// within the offset nothing decays, exp decays by the factor at offset + scale.
+	exp := &Decay{Func: DecayExp, Origin: now, Offset: 24 * time.Hour, Scale: 29 * 24 * time.Hour, Decay: 0.2}
+	assert.InDelta(t, 1, exp.factor(now-day, now), 1e-9)
+	assert.InDelta(t, 0.2, exp.factor(now-30*day, now), 1e-9)
+
+	_, err = index.Query(&Param{Query: "*", FunctionScore: &FunctionScore{Decay: &Decay{Func: "linear", Scale: time.Hour}}})
+	assert.IsType(t, &ParamError{}, err)
+	_, err = index.Query(&Param{Query: "*", FunctionScore: &FunctionScore{Decay: &Decay{Func: DecayExp}}})
+	assert.IsType(t, &ParamError{}, err)
+}
+
+func TestIncrPV(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	assert.Nil(t, err)
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+	err = index.AddDocuments(
+		&Document{PK: "a", Category: "go", PV: 5},
+		&Document{PK: "b", Category: "go", PV: 1},
+	)
+	assert.Nil(t, err)
+
+	pv, err := index.IncrPV("b", 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, pv)
+	pvs, err := index.IncrPVs(map[string]int{"b": 3, "c": 1})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"b": 7}, pvs)
+	_, err = index.IncrPV("c", 1)
+	assert.Equal(t, ErrDocumentNotFound, err)
+
+	// the pending views are sorted by and returned before they are flushed.
+	_, res, err := index.Search(&Param{Category: "go", Sort: Sorter{"pv", DESC}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b", "a"}, toPks(res))
+	assert.Equal(t, 7, res[0].PV)
+
+	assert.Nil(t, index.FlushPV())
+	var buf bytes.Buffer
+	_, err = index.Export(&buf)
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), `"pv":7`)
+
+	// the views of a deleted document don't count for the next one of its docId.
+	_, err = index.IncrPV("a", 10)
+	assert.Nil(t, err)
+	assert.Nil(t, index.DeleteDocument("a"))
+	assert.Nil(t, index.AddDocument(&Document{PK: "d", Category: "go"}))
+	_, res, err = index.Search(&Param{PKs: []string{"d"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res[0].PV)
+
+	// a new version of a document keeps the counted views, the flushed and the pending.
+	_, err = index.IncrPV("b", 2)
+	assert.Nil(t, err)
+	assert.Nil(t, index.AddDocument(&Document{PK: "b", Title: "bolt", Category: "go", PV: 1}))
+	_, res, err = index.Search(&Param{PKs: []string{"b"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 9, res[0].PV)
+	assert.Equal(t, "bolt", res[0].Title)
+
+	_, err = index.IncrPV("b", -1)
+	assert.Nil(t, err)
+	assert.Nil(t, index.Close())
+
+	index, err = NewIndex("/tmp/a.db")
+	defer index.Close()
+	assert.Nil(t, err)
+	_, res, err = index.Search(&Param{PKs: []string{"b"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 8, res[0].PV)
+}
+
+func TestUpdateDocument(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	assert.Nil(t, err)
+	defer index.Close()
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+	err = index.AddDocument(&Document{PK: "a", Title: "golang", FullText: "bolt", Tags: []string{"Go", "DB"}, Category: "tech", PV: 3})
+	assert.Nil(t, err)
+	_, err = index.IncrPV("a", 2)
+	assert.Nil(t, err)
+
+	tags := []string{"go", "search"}
+	title := "golang search"
+	doc, err := index.UpdateDocument("a", &DocumentPatch{Title: &title, Tags: &tags})
+	assert.Nil(t, err)
+	assert.Equal(t, "golang search", doc.Title)
+	assert.Equal(t, "bolt", doc.FullText)
+	assert.Equal(t, 5, doc.PV)
+
+	cnt, _, err := index.Search(&Param{Tags: []string{"db"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, cnt)
+	cnt, _, err = index.Search(&Param{Tags: []string{"search"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, cnt)
+	cnt, _, err = index.Search(&Param{Query: "bolt"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, cnt)
+	_, res, err := index.Search(&Param{Query: "search"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a"}, toPks(res))
+
+	pv := 1
+	doc, err = index.UpdateDocument("a", &DocumentPatch{PV: &pv})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, doc.PV)
+	assert.Equal(t, "golang search", doc.Title)
+
+	_, err = index.UpdateDocument("b", &DocumentPatch{Title: &title})
+	assert.Equal(t, ErrDocumentNotFound, err)
+}
+
+func TestMoreLikeThis(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	assert.Nil(t, err)
+	defer index.Close()
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+	err = index.AddDocuments(
+		&Document{PK: "a", Title: "golang bolt index", Tags: []string{"go"}, Category: "tech"},
+		&Document{PK: "b", Title: "bolt index tuning", Tags: []string{"db"}, Category: "tech"},
+		&Document{PK: "c", Title: "golang channels", Tags: []string{"go"}, Category: "tech"},
+		&Document{PK: "d", Title: "cooking pasta", Category: "food"},
+	)
+	assert.Nil(t, err)
+
+	res, err := index.MoreLikeThis("a", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, res.Total)
+	pks := make([]string, 0, len(res.Hits))
+	for _, hit := range res.Hits {
+		pks = append(pks, hit.PK)
+	}
+	assert.Equal(t, []string{"b", "c"}, pks)
+	assert.True(t, res.Hits[0].Score > res.Hits[1].Score)
+
+	res, err = index.MoreLikeThis("a", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res.Hits))
+
+	_, err = index.MoreLikeThis("x", 1)
+	assert.Equal(t, ErrDocumentNotFound, err)
+	_, err = index.MoreLikeThis("a", -1)
+	assert.NotNil(t, err)
+}
+
+func TestNearDuplicates(t *testing.T) {
+	text := "bolt is an embedded key value database for go, it stores the index of peanut in a single file"
+	opts := DefaultOptions
+	opts.Duplicates = DuplicatesReject
+	index, err := NewIndexWithOptions("/tmp/a.db", opts)
+	assert.Nil(t, err)
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+	err = index.AddDocuments(
+		&Document{PK: "a", FullText: text, Tags: []string{"go"}, PV: 2},
+		&Document{PK: "b", FullText: "cooking pasta takes ten minutes in boiling water"},
+	)
+	assert.Nil(t, err)
+
+	err = index.AddDocument(&Document{PK: "a?utm=feed", FullText: text + "."})
+	assert.Equal(t, &DuplicateError{PK: "a?utm=feed", Of: "a", Distance: 0}, err)
+	// a pk already stored is replaced, it isn't a duplicate of itself.
+	assert.Nil(t, index.AddDocument(&Document{PK: "a", FullText: text, Tags: []string{"go"}, PV: 2}))
+	// a rejected document is skipped, the others are indexed. A document without words has
+	// no fingerprint.
+	err = index.AddDocuments(&Document{PK: "a?utm=feed", FullText: text}, &Document{PK: "c"})
+	assert.Equal(t, &RejectedError{Duplicates: []*DuplicateError{{PK: "a?utm=feed", Of: "a", Distance: 0}}}, err)
+	docIds, err := index.SearchPks("c")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(docIds))
+	assert.Nil(t, index.AddDocument(&Document{PK: "d"}))
+	assert.Nil(t, index.Close())
+
+	opts.Duplicates = DuplicatesMerge
+	index, err = NewIndexWithOptions("/tmp/a.db", opts)
+	assert.Nil(t, err)
+	defer index.Close()
+
+	err = index.AddDocument(&Document{PK: "a?utm=feed", Title: "bolt", FullText: text, Tags: []string{"Go", "db"}, PV: 3})
+	assert.Nil(t, err)
+	_, res, err := index.Search(&Param{PKs: []string{"a", "a?utm=feed"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res))
+	assert.Equal(t, "a", res[0].PK)
+	assert.Equal(t, "bolt", res[0].Title)
+	assert.Equal(t, []string{"go", "db"}, res[0].Tags)
+	assert.Equal(t, 5, res[0].PV)
+
+	// the pv of a pk merged again replaces the one merged before.
+	assert.Nil(t, index.AddDocument(&Document{PK: "a?utm=feed", FullText: text, PV: 3}))
+	assert.Nil(t, index.AddDocument(&Document{PK: "a?utm=feed", FullText: text, PV: 4}))
+	_, res, err = index.Search(&Param{PKs: []string{"a"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 6, res[0].PV)
+
+	// the duplicates added before the policy are collapsed at query time.
+	index.opts.Duplicates = DuplicatesAllow
+	assert.Nil(t, index.AddDocument(&Document{PK: "e", FullText: text, PV: 9}))
+	dups, err := index.NearDuplicates("a")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(dups))
+	assert.Equal(t, "e", dups[0].PK)
+	assert.Equal(t, 0, dups[0].Distance)
+
+	r, err := index.Query(&Param{Query: "*", CollapseDuplicates: true, Sort: Sorter{"pv", DESC}})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, r.Total)
+	assert.Equal(t, 1, r.Collapsed)
+	assert.Equal(t, "e", r.Hits[0].PK)
+	for _, hit := range r.Hits {
+		assert.NotEqual(t, "a", hit.PK)
+	}
+
+	// the fingerprint follows the full text.
+	other := "a completely different article about search engines"
+	_, err = index.UpdateDocument("e", &DocumentPatch{FullText: &other})
+	assert.Nil(t, err)
+	dups, err = index.NearDuplicates("a")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(dups))
+	assert.Nil(t, index.DeleteDocument("a"))
+	report, err := index.Check()
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	buckets, err := index.Buckets()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, buckets[string(mergedIndexName)])
+}
+
+func TestCollapseBy(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	assert.Nil(t, err)
+	defer index.Close()
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+	err = index.AddDocuments(
+		&Document{PK: "a", Category: "go", Tags: []string{"series-bolt"}, Link: "https://www.cyeam.com/a", PV: 6},
+		&Document{PK: "b", Category: "go", Tags: []string{"Series-Bolt"}, Link: "https://cyeam.com/b", PV: 5},
+		&Document{PK: "c", Category: "db", Tags: []string{"series-sego"}, Link: "https://blog.golang.org/c", PV: 4},
+		&Document{PK: "d", Category: "go", Link: "https://cyeam.com/d", PV: 3},
+		&Document{PK: "e", PV: 2},
+	)
+	assert.Nil(t, err)
+
+	sorter := Sorter{"pv", DESC}
+	res, err := index.Query(&Param{Query: "*", Sort: sorter, CollapseBy: CollapseByLinkHost})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, res.Total)
+	assert.Equal(t, 2, res.Collapsed)
+	assert.Equal(t, "a", res.Hits[0].PK)
+	assert.Equal(t, "cyeam.com", res.Hits[0].Group)
+	assert.Equal(t, 2, res.Hits[0].Collapsed)
+	assert.Equal(t, "c", res.Hits[1].PK)
+	assert.Equal(t, "e", res.Hits[2].PK)
+
+	res, err = index.Query(&Param{Query: "*", Sort: sorter, CollapseBy: CollapseByTag + "series-"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "c", "d", "e"}, []string{res.Hits[0].PK, res.Hits[1].PK, res.Hits[2].PK, res.Hits[3].PK})
+
+	res, err = index.Query(&Param{Query: "*", Sort: sorter, CollapseBy: CollapseByCategory, GroupSize: 2, Size: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, res.Total)
+	assert.Equal(t, 0, len(res.Hits))
+	assert.Equal(t, 2, len(res.Groups))
+	assert.Equal(t, "go", res.Groups[0].Key)
+	assert.Equal(t, 3, res.Groups[0].Total)
+	assert.Equal(t, "a", res.Groups[0].Hits[0].PK)
+	assert.Equal(t, "b", res.Groups[0].Hits[1].PK)
+	assert.Equal(t, "db", res.Groups[1].Key)
+	assert.Equal(t, 1, len(res.Groups[1].Hits))
+
+	// the group values follow a partial update.
+	category := "db"
+	_, err = index.UpdateDocument("a", &DocumentPatch{Category: &category})
+	assert.Nil(t, err)
+	res, err = index.Query(&Param{Query: "*", Sort: sorter, CollapseBy: CollapseByCategory})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b", "e"}, []string{res.Hits[0].PK, res.Hits[1].PK, res.Hits[2].PK})
+
+	_, err = index.Query(&Param{Query: "*", CollapseBy: "title"})
+	assert.IsType(t, &ParamError{}, err)
+	_, err = index.Query(&Param{Query: "*", GroupSize: 2})
+	assert.IsType(t, &ParamError{}, err)
+}
+
+func TestTagFilters(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	assert.Nil(t, err)
+	defer index.Close()
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+	err = index.AddDocuments(
+		&Document{PK: "a", Tags: []string{"go", "db"}, Category: "tech"},
+		&Document{PK: "b", Tags: []string{"go"}, Category: "tech"},
+		&Document{PK: "c", Tags: []string{"db"}, Category: "ops"},
+		&Document{PK: "d", Category: "life"},
+	)
+	assert.Nil(t, err)
+
+	// a document with several of the tags is matched once.
+	docIds, err := index.SearchTag("go", "db")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(docIds))
+
+	search := func(param *Param) []string {
+		param.SortBy = []SortClause{{Field: "pk", Asc: ASC}}
+		_, res, err := index.Search(param)
+		assert.Nil(t, err)
+		return toPks(res)
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, search(&Param{Tags: []string{"Go", "db"}}))
+	assert.Equal(t, []string{"a", "b", "c"}, search(&Param{TagsAny: []string{"go", "db"}}))
+	assert.Equal(t, []string{"a"}, search(&Param{TagsAll: []string{"go", "DB"}}))
+	assert.Equal(t, []string{}, search(&Param{TagsAll: []string{"go", "rust"}}))
+	assert.Equal(t, []string{"c", "d"}, search(&Param{TagsNone: []string{"go"}}))
+	assert.Equal(t, []string{"b"}, search(&Param{Tags: []string{"go"}, TagsNone: []string{"db"}}))
+	assert.Equal(t, []string{"a", "b", "c"}, search(&Param{Categories: []string{"tech", "ops"}}))
+	assert.Equal(t, []string{"c"}, search(&Param{Category: "ops", Categories: []string{"tech", "ops"}}))
+	assert.Equal(t, []string{"a", "b", "d"}, search(&Param{Query: "*", CategoriesNone: []string{"ops"}}))
+	assert.Equal(t, []string{"c"}, search(&Param{TagsAny: []string{"db"}, CategoriesNone: []string{"tech"}}))
+
+	res, err := index.Query(&Param{TagsAll: []string{"go", "db"}, TagsNone: []string{"rust"}, Explain: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"tags all of [go db]", "tags none of [rust]"}, res.Hits[0].Explanation.Filters)
+	assert.Equal(t, []string{"go", "db"}, res.Hits[0].Explanation.Matches["tags"])
+}
+
+func TestCategoryPaths(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	assert.Nil(t, err)
+	defer index.Close()
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+	err = index.AddDocuments(
+		&Document{PK: "a", Category: "Tech/Go/JSON", PV: 5},
+		&Document{PK: "b", Category: "tech/go", PV: 4},
+		&Document{PK: "c", Category: " tech//db/ ", PV: 3},
+		&Document{PK: "d", Category: "life", PV: 2},
+		&Document{PK: "e", PV: 1},
+	)
+	assert.Nil(t, err)
+
+	search := func(param *Param) []string {
+		param.Sort = Sorter{"pv", DESC}
+		_, res, err := index.Search(param)
+		assert.Nil(t, err)
+		return toPks(res)
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, search(&Param{Category: "tech"}))
+	assert.Equal(t, []string{"a", "b"}, search(&Param{Category: "Tech/Go/"}))
+	assert.Equal(t, []string{"a"}, search(&Param{Categories: []string{"tech/go/json"}}))
+	assert.Equal(t, []string{"c", "d", "e"}, search(&Param{Query: "*", CategoriesNone: []string{"tech/go"}}))
+
+	tree, err := index.CategoryTree()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, tree.Count)
+	assert.Equal(t, 2, len(tree.Children))
+	assert.Equal(t, "life", tree.Children[0].Name)
+	tech := tree.Children[1]
+	assert.Equal(t, 3, tech.Count)
+	assert.Equal(t, []string{"db", "go"}, []string{tech.Children[0].Name, tech.Children[1].Name})
+	assert.Equal(t, 2, tech.Children[1].Count)
+	assert.Equal(t, "tech/go/json", tech.Children[1].Children[0].Path)
+
+	res, err := index.Query(&Param{PKs: []string{"a"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []*Breadcrumb{{"Tech", "tech"}, {"Go", "tech/go"}, {"JSON", "tech/go/json"}}, res.Hits[0].Breadcrumbs)
+
+	// the ancestors follow an update of the category.
+	category := "life/travel"
+	_, err = index.UpdateDocument("a", &DocumentPatch{Category: &category})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "d"}, search(&Param{Category: "life"}))
+	assert.Equal(t, []string{"b"}, search(&Param{Category: "tech/go"}))
+
+	// f is counted once in its deepest path, though x/y isn't stored and no document is in x.
+	assert.Nil(t, index.AddDocument(&Document{PK: "f", Category: "x/y/z"}))
+	err = index.writer.write(func(tx *bolt.Tx, status *bitset.BitSet) error {
+		return tx.Bucket(categoryIndexName).Delete([]byte("x/y"))
+	})
+	assert.Nil(t, err)
+	tree, err = index.CategoryTree()
+	assert.Nil(t, err)
+	assert.Equal(t, 5, tree.Count)
+	assert.Equal(t, []string{"life", "tech", "x"}, []string{tree.Children[0].Name, tree.Children[1].Name, tree.Children[2].Name})
+	x := tree.Children[2]
+	assert.Equal(t, 1, x.Count)
+	assert.Equal(t, "x/y", x.Children[0].Path)
+	assert.Equal(t, 1, x.Children[0].Count)
+	assert.Equal(t, 1, x.Children[0].Children[0].Count)
+	assert.Equal(t, 2, tree.Children[0].Count)
+}
+
+func TestMigrateCategoryPaths(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	assert.Nil(t, err)
+	defer index.Close()
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+	categories := []string{"Tech/Go", "tech//db", "Life ", "news", ""}
+	for i, c := range categories {
+		assert.Nil(t, index.AddDocument(&Document{PK: fmt.Sprint(i), Category: c, PV: len(categories) - i}))
+	}
+
+	docIds, err := index.SearchPks("0", "1", "2", "3", "4")
+	assert.Nil(t, err)
+
+	// index the documents by their lowercased categories, as before the paths.
+	err = index.writer.write(func(tx *bolt.Tx, status *bitset.BitSet) error {
+		if err := tx.DeleteBucket(categoryIndexName); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(categoryIndexName); err != nil {
+			return err
+		}
+		for i, c := range categories {
+			if c == "" {
+				continue
+			}
+			if err := index.category.AppendBytesUintsTx(tx, []byte(strings.ToLower(c)), docIds[i]); err != nil {
+				return err
+			}
+		}
+		return index._index.DeleteTx(tx, metaIndexName, categoryPathsKey)
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, index.migrateCategoryPaths())
+
+	search := func(category string) []string {
+		_, res, err := index.Search(&Param{Category: category, Sort: Sorter{"pv", DESC}})
+		assert.Nil(t, err)
+		return toPks(res)
+	}
+	assert.Equal(t, []string{"0", "1"}, search("tech"))
+	assert.Equal(t, []string{"1"}, search("tech/db"))
+	assert.Equal(t, []string{"2"}, search("life"))
+	assert.Equal(t, []string{"3"}, search("news"))
+
+	// the old terms are gone.
+	var terms []string
+	assert.Nil(t, index.ForEachTerm("category", func(term string, docIds []uint32) error {
+		terms = append(terms, term)
+		return nil
+	}))
+	assert.Equal(t, []string{"life", "news", "tech", "tech/db", "tech/go"}, terms)
+}
+
+func TestWildcardQuery(t *testing.T) {
+	index, err := NewIndex("/tmp/a.db")
+	assert.Nil(t, err)
+	defer index.Close()
+
+	err = index.ClearAll()
+	assert.Nil(t, err)
+	err = index.AddDocuments(
+		&Document{PK: "a", Title: "JSON parser", PV: 5},
+		&Document{PK: "b", FullText: "jsonp callback", PV: 4},
+		&Document{PK: "c", Brief: "json-rpc server", PV: 3},
+		&Document{PK: "d", FullText: "数据处理", PV: 2},
+		&Document{PK: "e", Title: "golang", PV: 1},
+	)
+	assert.Nil(t, err)
+
+	search := func(query string) []string {
+		_, res, err := index.Search(&Param{Query: query, Wildcards: true, Sort: Sorter{"pv", DESC}})
+		assert.Nil(t, err)
+		return toPks(res)
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, search("json*"))
+	assert.Equal(t, []string{"b"}, search("JSON?"))
+	// a leading wildcard is sought in the reversed terms.
+	assert.Equal(t, []string{"a", "c"}, search("*son"))
+	assert.Equal(t, []string{"d"}, search("*理"))
+	assert.Equal(t, []string{"a", "b", "c"}, search("/js(on|onp)/"))
+	assert.Equal(t, []string{"c", "e"}, search("golang /rp./"))
+
+	// the words are text unless the wildcards are asked for.
+	_, res, err := index.Search(&Param{Query: "golang?"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"e"}, toPks(res))
+	assert.Equal(t, 0, len(search("golang?")))
+
+	// a pattern without a literal prefix or suffix would read every term.
+	for _, query := range []string{"json **", "*so*", "/.*son/", "/(/"} {
+		_, _, err = index.Search(&Param{Query: query, Wildcards: true})
+		assert.IsType(t, &ParamError{}, err, query)
+	}
+
+	assert.Nil(t, index.AddDocument(&Document{PK: "f", Title: "javascript"}))
+	scanned := maxScannedTerms
+	maxScannedTerms = 1
+	r, err := index.Query(&Param{Query: "j*", Wildcards: true, Explain: true})
+	maxScannedTerms = scanned
+	assert.Nil(t, err)
+	assert.Contains(t, r.Trace[0].Detail, "capped")
+	assert.Equal(t, []string{"javascript"}, r.Trace[0].Terms)
+
+	r, err = index.Query(&Param{Query: "json*", Wildcards: true, Sort: Sorter{"pv", DESC}, Explain: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"json*"}, r.Hits[0].Explanation.Matches["title"])
+	assert.Equal(t, "expand", r.Trace[0].Op)
+	assert.Equal(t, []string{"json"}, r.Trace[0].Terms)
+
+	// the reversed term goes with the last posting of the term.
+	err = index.DeleteDocument("a")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c"}, search("*son"))
+	err = index.DeleteDocument("c")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(search("*son")))
+	n := 0
+	err = index.GetDB().View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(briefReverseIndexName).Stats().KeyN + tx.Bucket(titleReverseIndexName).Stats().KeyN
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+}
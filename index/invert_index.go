@@ -3,6 +3,7 @@ package index
 import (
 	"fmt"
 
+	"github.com/boltdb/bolt"
 	"github.com/mnhkahn/gods/xencoding"
 	"github.com/mnhkahn/gods/xsort"
 	"github.com/mnhkahn/gogogo/logger"
@@ -11,6 +12,9 @@ import (
 type InvertIndex struct {
 	btname []byte
 	btree  *BTree
+	// reverse is the bucket of the reversed terms, nil if there is none, see
+	// withReverse.
+	reverse []byte
 }
 
 func NewInvertIndex(btname []byte, btree *BTree) (*InvertIndex, error) {
@@ -43,18 +47,38 @@ func (t *InvertIndex) SetUIntUint(key uint32, value uint32) error {
 	return t.btree.Set(t.btname, xencoding.Uint2Bytes(key), xencoding.Uint2Bytes(value))
 }
 
+// appendUints inserts value into the sorted docIds, docIds is not modified.
 func (t *InvertIndex) appendUints(docIds []uint32, value ...uint32) ([]uint32, bool) {
+	res := make([]uint32, len(docIds), len(docIds)+len(value))
+	copy(res, docIds)
+
 	hasNewDoc := false
 	for _, v := range value {
-		if xsort.SearchUIntsExists(docIds, v) == -1 {
-			hasNewDoc = true
-			value = append(docIds, v)
+		pos := xsort.SearchUInts(res, v)
+		if pos < len(res) && res[pos] == v {
+			continue
 		}
+		hasNewDoc = true
+		res = append(res, 0)
+		copy(res[pos+1:], res[pos:])
+		res[pos] = v
 	}
-	if hasNewDoc {
-		xsort.UInt32s(value)
+	return res, hasNewDoc
+}
+
+// removeUints removes value from the sorted docIds, docIds is not modified.
+func (t *InvertIndex) removeUints(docIds []uint32, value ...uint32) ([]uint32, bool) {
+	res := make([]uint32, len(docIds))
+	copy(res, docIds)
+
+	removed := false
+	for _, v := range value {
+		if pos := xsort.SearchUIntsExists(res, v); pos != -1 {
+			removed = true
+			res = append(res[:pos], res[pos+1:]...)
+		}
 	}
-	return value, hasNewDoc
+	return res, removed
 }
 
 func (t *InvertIndex) AppendUintUints(key uint32, value ...uint32) error {
@@ -67,11 +91,7 @@ func (t *InvertIndex) AppendUintUints(key uint32, value ...uint32) error {
 		return err
 	}
 
-	hasNewDoc := false
-	if exists {
-		value, hasNewDoc = t.appendUints(docIds, value...)
-	}
-
+	value, hasNewDoc := t.appendUints(docIds, value...)
 	if !exists || hasNewDoc {
 		err = t.btree.Set(t.btname, xencoding.Uint2Bytes(key), xencoding.Uints2Bytes(value))
 		if err != nil {
@@ -127,11 +147,7 @@ func (t *InvertIndex) AppendUint64Uints(key uint64, value ...uint32) error {
 		return err
 	}
 
-	hasNewDoc := false
-	if exists {
-		value, hasNewDoc = t.appendUints(docIds, value...)
-	}
-
+	value, hasNewDoc := t.appendUints(docIds, value...)
 	if !exists || hasNewDoc {
 		err = t.btree.Set(t.btname, xencoding.Uint642Bytes(key), xencoding.Uints2Bytes(value))
 		if err != nil {
@@ -172,51 +188,78 @@ func (t *InvertIndex) DeleteUint64Uints(key uint64, value ...uint32) error {
 }
 
 func (t *InvertIndex) AppendBytesUints(key []byte, value ...uint32) error {
+	return t.btree.Update(func(tx *bolt.Tx) error {
+		return t.AppendBytesUintsTx(tx, key, value...)
+	})
+}
+
+// AppendBytesUintsTx inserts value into the posting list of key in tx.
+func (t *InvertIndex) AppendBytesUintsTx(tx *bolt.Tx, key []byte, value ...uint32) error {
 	if len(value) == 0 {
 		return fmt.Errorf("append uints is nil")
 	}
 
-	docIds, exists, err := t.SearchBytesUints(key)
+	docIds, exists, err := t.SearchBytesUintsTx(tx, key)
 	if err != nil {
 		return err
 	}
 
-	hasNewDoc := false
-	if exists {
-		value, hasNewDoc = t.appendUints(docIds, value...)
-	}
-
+	value, hasNewDoc := t.appendUints(docIds, value...)
 	if !exists || hasNewDoc {
-		err = t.btree.Set(t.btname, key, xencoding.Uints2Bytes(value))
+		err = t.btree.SetTx(tx, t.btname, key, xencoding.Uints2Bytes(value))
 		if err != nil {
 			return err
 		}
 	}
+	if !exists {
+		return t.setReverseTx(tx, key)
+	}
 
 	return nil
 }
 
 func (t *InvertIndex) DeleteBytesUints(key []byte, value ...uint32) error {
+	return t.btree.Update(func(tx *bolt.Tx) error {
+		return t.DeleteBytesUintsTx(tx, key, value...)
+	})
+}
+
+// DeleteBytesUintsTx removes value from the posting list of key in tx,
+// the key is deleted if its posting list is empty.
+func (t *InvertIndex) DeleteBytesUintsTx(tx *bolt.Tx, key []byte, value ...uint32) error {
 	if len(value) == 0 {
 		return fmt.Errorf("delete uints is nil")
 	}
 
-	docIds, exists, err := t.SearchBytesUints(key)
-	if err != nil {
+	docIds, exists, err := t.SearchBytesUintsTx(tx, key)
+	if err != nil || !exists {
 		return err
 	}
 
-	if exists {
-		newDocIds := make([]uint32, 0, len(docIds))
-		copy(newDocIds, docIds)
-		for _, v := range value {
-			if pos := xsort.SearchUInts(newDocIds, v); pos != -1 {
-				newDocIds = append(newDocIds[:pos], newDocIds[pos+1:]...)
-			}
-		}
-		t.btree.Set(t.btname, key, xencoding.Uints2Bytes(newDocIds))
+	newDocIds, removed := t.removeUints(docIds, value...)
+	if !removed {
+		return nil
+	}
+	if len(newDocIds) == 0 {
+		return t.deleteTermTx(tx, key)
 	}
+	return t.btree.SetTx(tx, t.btname, key, xencoding.Uints2Bytes(newDocIds))
+}
 
+// deleteTermsTx removes docId from the posting lists of the terms that are not in keep.
+func (t *InvertIndex) deleteTermsTx(tx *bolt.Tx, terms, keep []string, docId uint32) error {
+	kept := make(map[string]bool, len(keep))
+	for _, k := range keep {
+		kept[k] = true
+	}
+	for _, term := range terms {
+		if kept[term] {
+			continue
+		}
+		if err := t.DeleteBytesUintsTx(tx, []byte(term), docId); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -252,6 +295,15 @@ func (t *InvertIndex) SearchBytesUints(key []byte) ([]uint32, bool, error) {
 	return xencoding.Bytes2Uints(value), true, nil
 }
 
+// SearchBytesUintsTx gets the posting list of key in tx.
+func (t *InvertIndex) SearchBytesUintsTx(tx *bolt.Tx, key []byte) ([]uint32, bool, error) {
+	value, exists, err := t.btree.SearchTx(tx, t.btname, key)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+	return xencoding.Bytes2Uints(value), true, nil
+}
+
 func (t *InvertIndex) SearchUintsInt16(key []uint32) (int16, bool, error) {
 	value, exists, err := t.btree.Search(t.btname, xencoding.Uints2Bytes(key))
 	if err != nil || !exists {
@@ -299,6 +351,11 @@ func (t *InvertIndex) SetUIntBytes(key uint32, value []byte) error {
 	return t.btree.Set(t.btname, xencoding.Uint2Bytes(key), value)
 }
 
+// SetUIntBytesTx puts key in tx.
+func (t *InvertIndex) SetUIntBytesTx(tx *bolt.Tx, key uint32, value []byte) error {
+	return t.btree.SetTx(tx, t.btname, xencoding.Uint2Bytes(key), value)
+}
+
 func (t *InvertIndex) SearchUIntBytes(key uint32) ([]byte, bool, error) {
 	value, exists, err := t.btree.Search(t.btname, xencoding.Uint2Bytes(key))
 	if err != nil || !exists {
@@ -307,6 +364,16 @@ func (t *InvertIndex) SearchUIntBytes(key uint32) ([]byte, bool, error) {
 	return value, true, nil
 }
 
+// SearchUIntBytesTx gets key in tx.
+func (t *InvertIndex) SearchUIntBytesTx(tx *bolt.Tx, key uint32) ([]byte, bool, error) {
+	return t.btree.SearchTx(tx, t.btname, xencoding.Uint2Bytes(key))
+}
+
 func (t *InvertIndex) DeleteUIntBytes(key uint32) error {
 	return t.btree.Delete(t.btname, xencoding.Uint2Bytes(key))
 }
+
+// DeleteUIntBytesTx deletes key in tx.
+func (t *InvertIndex) DeleteUIntBytesTx(tx *bolt.Tx, key uint32) error {
+	return t.btree.DeleteTx(tx, t.btname, xencoding.Uint2Bytes(key))
+}
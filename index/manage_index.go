@@ -1,93 +1,312 @@
 package index
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 
-	"github.com/vmihailenco/msgpack"
-
-	"github.com/huichen/sego"
+	"github.com/boltdb/bolt"
 	"github.com/mnhkahn/gogogo/logger"
-	"github.com/mnhkahn/gogogo/panicer"
-	"github.com/mnhkahn/peanut/util"
+	"github.com/vmihailenco/msgpack"
+	"github.com/willf/bitset"
 )
 
-func (index *Index) createCurIdIfNotExists(pk string) (uint32, error) {
-	docIds, err := index.SearchPks(pk)
-	if err != nil {
-		return 0, err
-	} else if len(docIds) == 1 {
-		logger.Infof("reuse docId: %d, pk: %s", docIds[0], pk)
-		return docIds[0], nil
+var ErrDocumentNotFound = errors.New("document not found")
+
+// fieldTerms is the terms of a document in an inverted index.
+type fieldTerms struct {
+	field *InvertIndex
+	terms []string
+}
+
+// termFields are the fields of a document with terms, pk aside.
+var termFields = []string{"title", "brief", "full_text", "tags", "category"}
+
+// documentTerms returns the terms of every field of termFields of doc, without duplicates.
+func (index *Index) documentTerms(doc *Document) []fieldTerms {
+	res := make([]fieldTerms, 0, len(termFields))
+	for _, name := range termFields {
+		res = append(res, index.fieldTerms(name, doc))
 	}
-	return index.getCurId(), nil
+	return res
 }
 
-func (index *Index) getCurId() uint32 {
-	curId, valid := index.status.NextClear(0)
+// fieldTerms returns the terms of the field name of doc, name is one of termFields.
+func (index *Index) fieldTerms(name string, doc *Document) fieldTerms {
+	switch name {
+	case "title":
+		return fieldTerms{index.title, uniqueTerms(index.segment(doc.Title))}
+	case "brief":
+		return fieldTerms{index.brief, uniqueTerms(index.segment(doc.Brief))}
+	case "full_text":
+		return fieldTerms{index.fullText, uniqueTerms(index.segment(doc.FullText))}
+	case "tags":
+		tags := make([]string, 0, len(doc.Tags))
+		for _, tag := range doc.Tags {
+			tags = append(tags, strings.ToLower(tag))
+		}
+		return fieldTerms{index.tag, uniqueTerms(tags)}
+	}
+	return fieldTerms{index.category, uniqueTerms(categoryPaths(doc.Category))}
+}
+
+// uniqueTerms removes the duplicate and the empty terms, bolt can't store an empty key.
+func uniqueTerms(terms []string) []string {
+	seen := make(map[string]bool, len(terms))
+	res := terms[:0]
+	for _, t := range terms {
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		res = append(res, t)
+	}
+	return res
+}
+
+// nextDocId returns the first free docId of status.
+func nextDocId(status *bitset.BitSet) uint32 {
+	curId, valid := status.NextClear(0)
 	if valid {
-		return curId
+		return uint32(curId)
 	}
-	return index.status.Len()
+	return uint32(status.Len())
 }
 
-func (index *Index) AddDocument(doc *Document) error {
-	defer panicer.RecoverDebug(doc.PK)
+// docIdTx returns the docId of pk and the document stored for it, or a free docId
+// and nil for a new pk.
+func (index *Index) docIdTx(tx *bolt.Tx, status *bitset.BitSet, pk string) (uint32, *Document, error) {
+	docIds, exists, err := index.pk.SearchBytesUintsTx(tx, []byte(pk))
+	if err != nil {
+		return 0, nil, err
+	} else if !exists || len(docIds) != 1 {
+		return nextDocId(status), nil, nil
+	}
+
+	logger.Infof("reuse docId: %d, pk: %s", docIds[0], pk)
+	old, err := index.documentTx(tx, docIds[0])
+	return docIds[0], old, err
+}
 
+// documentTx returns the document stored for docId, or nil if there is none or it can't
+// be decoded, then its terms are kept.
+func (index *Index) documentTx(tx *bolt.Tx, docId uint32) (*Document, error) {
+	byts, exists, err := index.documents.SearchUIntBytesTx(tx, docId)
+	if err != nil || !exists {
+		return nil, err
+	}
+	doc := new(Document)
+	if err = msgpack.Unmarshal(byts, doc); err != nil {
+		logger.Warnf("decode document %d: %v, its old terms are kept.", docId, err)
+		return nil, nil
+	}
+	return doc, nil
+}
+
+// AddDocument indexes doc, a near duplicate rejected by Options.Duplicates fails with a
+// *DuplicateError.
+func (index *Index) AddDocument(doc *Document) error {
 	if doc == nil {
 		return fmt.Errorf("document is nil")
 	}
+	err := index.AddDocuments(doc)
+	if rejected, ok := err.(*RejectedError); ok {
+		return rejected.Duplicates[0]
+	}
+	return err
+}
 
-	var err error
+// AddDocuments indexes docs in a single transaction with the status bitmap, either all
+// of them are indexed or none is, but the near duplicates rejected by Options.Duplicates:
+// they are skipped and returned in a *RejectedError. It's safe for concurrent use, the
+// writes are queued to the single writer of the index. A document of a pk already stored
+// keeps its pv, the pv is counted by IncrPV and set by UpdateDocument.
+func (index *Index) AddDocuments(docs ...*Document) error {
+	for _, doc := range docs {
+		if doc == nil {
+			return fmt.Errorf("document is nil")
+		}
+	}
 
-	// ========== Lock =============
-	index.documentLock.Lock()
-	docId, err := index.createCurIdIfNotExists(doc.PK)
-	logger.Infof("add document doc: %d, %v", docId, doc.PK)
+	var rejected []*DuplicateError
+	err := index.writer.write(func(tx *bolt.Tx, status *bitset.BitSet) error {
+		// the writer runs op again if the batch it's part of fails.
+		rejected = nil
+		for _, doc := range docs {
+			err := index.addDocumentTx(tx, status, doc)
+			if dup, ok := err.(*DuplicateError); ok {
+				rejected = append(rejected, dup)
+			} else if err != nil {
+				return fmt.Errorf("add document %s: %s", doc.PK, err)
+			}
+		}
+		return nil
+	})
+	if err == nil && len(rejected) > 0 {
+		return &RejectedError{Duplicates: rejected}
+	}
+	return err
+}
+
+// addDocumentTx writes doc in tx and sets its bit in status. If doc replaces a stored
+// document, the postings of the terms it no longer has are removed and its pv is kept. A
+// new pk is checked for near duplicates by Options.Duplicates.
+func (index *Index) addDocumentTx(tx *bolt.Tx, status *bitset.BitSet, doc *Document) error {
+	docId, old, err := index.docIdTx(tx, status, doc.PK)
 	if err != nil {
-		index.documentLock.Unlock()
 		return err
 	}
-	index.status.Set(docId)
-	err = index.pk.AppendBytesUints([]byte(doc.PK), docId)
+	if status.Test(uint(docId)) {
+		if doc, err = index.keepPVTx(tx, docId, doc); err != nil {
+			return err
+		}
+	}
+
+	if index.opts.Duplicates != DuplicatesAllow && !status.Test(uint(docId)) {
+		ofId, merged, ok, err := index.duplicateTx(tx, doc)
+		if err != nil {
+			return err
+		} else if ok {
+			of, err := index.documentTx(tx, ofId)
+			if err != nil {
+				return err
+			}
+			return index.indexDocumentTx(tx, status, ofId, of, merged)
+		}
+	}
+	return index.indexDocumentTx(tx, status, docId, old, doc)
+}
+
+// keepPVTx returns a copy of doc with the pv stored for docId, the pending views of its pk
+// are added when they are flushed.
+func (index *Index) keepPVTx(tx *bolt.Tx, docId uint32, doc *Document) (*Document, error) {
+	pv, exists, err := index._index.SearchTx(tx, docValuesIndexName, docValueKey("pv", docId))
+	if err != nil || !exists {
+		return doc, err
+	}
+	kept := *doc
+	kept.PV = int(decodeInt(pv))
+	return &kept, nil
+}
+
+// indexDocumentTx writes doc as docId, old is the document stored for docId.
+func (index *Index) indexDocumentTx(tx *bolt.Tx, status *bitset.BitSet, docId uint32, old, doc *Document) error {
+	logger.Infof("add document doc: %d, %v", docId, doc.PK)
+
+	err := index.extendMaybe(docId)
 	if err != nil {
-		index.documentLock.Unlock()
 		return err
 	}
 
-	if err = index.extendMaybe(docId); err != nil {
-		index.documentLock.Unlock()
-		return fmt.Errorf("error: %s docId: %v", err.Error(), doc)
+	status.Set(uint(docId))
+	err = index.pk.AppendBytesUintsTx(tx, []byte(doc.PK), docId)
+	if err != nil {
+		return err
 	}
 
-	b, _ := msgpack.Marshal(doc)
-	err = index.documents.SetUIntBytes(docId, b)
+	b, err := msgpack.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	err = index.documents.SetUIntBytesTx(tx, docId, b)
+	if err != nil {
+		return err
+	}
+	err = index.setDocValuesTx(tx, docId, doc)
+	if err != nil {
+		return err
+	}
+	err = index.setSimHashTx(tx, docId, doc)
+	if err != nil {
+		return err
+	}
+	err = index.setGroupValuesTx(tx, docId, doc)
 	if err != nil {
 		return err
 	}
 
-	index.documentLock.Unlock()
-	// ========== Lock =============
-
-	// add title index
-	for _, t := range sego.SegmentsToSlice(index.segmenter.Segment([]byte(doc.Title)), false) {
-		index.title.AppendBytesUints([]byte(t), docId)
+	newTerms := index.documentTerms(doc)
+	if old != nil {
+		for i, ft := range index.documentTerms(old) {
+			err = ft.field.deleteTermsTx(tx, ft.terms, newTerms[i].terms, docId)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	for _, t := range sego.SegmentsToSlice(index.segmenter.Segment([]byte(doc.Brief)), false) {
-		index.brief.AppendBytesUints([]byte(t), docId)
+	for _, ft := range newTerms {
+		for _, t := range ft.terms {
+			err = ft.field.AppendBytesUintsTx(tx, []byte(t), docId)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	for _, t := range sego.SegmentsToSlice(index.segmenter.Segment([]byte(doc.FullText)), false) {
-		index.fullText.AppendBytesUints([]byte(t), docId)
+	return nil
+}
+
+// DeleteDocument removes the document of pk, its docId is reused by a later document.
+func (index *Index) DeleteDocument(pk string) error {
+	err := index.writer.write(func(tx *bolt.Tx, status *bitset.BitSet) error {
+		return index.deleteDocumentTx(tx, status, pk)
+	})
+	if err != nil {
+		return err
 	}
+	// the pending views are dropped by the next flush anyway, the pk has no docId.
+	index.counters.forget(pk)
+	return nil
+}
 
-	for _, tag := range doc.Tags {
-		index.tag.AppendBytesUints(util.StrToLowerBytes(tag), docId)
+// deleteDocumentTx deletes the documents of pk in tx.
+func (index *Index) deleteDocumentTx(tx *bolt.Tx, status *bitset.BitSet, pk string) error {
+	docIds, exists, err := index.pk.SearchBytesUintsTx(tx, []byte(pk))
+	if err != nil {
+		return err
+	} else if !exists {
+		return ErrDocumentNotFound
 	}
 
-	index.category.AppendBytesUints(util.StrToLowerBytes(doc.Category), docId)
+	for _, docId := range docIds {
+		logger.Infof("delete document doc: %d, %v", docId, pk)
+		old, err := index.documentTx(tx, docId)
+		if err != nil {
+			return err
+		}
+		// the terms of an undecodable document are left to Compact.
+		if old != nil {
+			for _, ft := range index.documentTerms(old) {
+				if err = ft.field.deleteTermsTx(tx, ft.terms, nil, docId); err != nil {
+					return err
+				}
+			}
+		}
+		if err = index.removeDocumentTx(tx, status, docId); err != nil {
+			return err
+		}
+	}
+	if err = index.deleteMergedTx(tx, pk); err != nil {
+		return err
+	}
+	return index._index.DeleteTx(tx, pkIndexName, []byte(pk))
+}
 
-	return index.Commit()
+// removeDocumentTx clears docId in status and deletes its document and the values derived
+// from it, its postings are left to the caller.
+func (index *Index) removeDocumentTx(tx *bolt.Tx, status *bitset.BitSet, docId uint32) error {
+	status.Clear(uint(docId))
+	if err := index.documents.DeleteUIntBytesTx(tx, docId); err != nil {
+		return err
+	}
+	if err := index.deleteSimHashTx(tx, docId); err != nil {
+		return err
+	}
+	if err := index.deleteGroupValuesTx(tx, docId); err != nil {
+		return err
+	}
+	return index.deleteDocValuesTx(tx, docId)
 }
 
 func (index *Index) Commit() error {
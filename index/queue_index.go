@@ -0,0 +1,304 @@
+package index
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/mnhkahn/gods/xencoding"
+	"github.com/mnhkahn/gogogo/logger"
+	"github.com/willf/bitset"
+)
+
+// queueBatchSize is the max number of queued documents applied in one write.
+const queueBatchSize = 500
+
+// walCompactSize is the size from which the applied records are dropped from the wal
+// while documents are pending, once they are at least half of it.
+var walCompactSize int64 = 16 << 20
+
+var (
+	metaIndexName = []byte("Meta")
+	walAppliedKey = []byte("wal_applied")
+)
+
+// queue holds the documents enqueued but not indexed yet. They are written to the
+// wal first, the indexer applies them in batches and records the last applied seq
+// in the same transaction, so the entries left in the wal are replayed on open.
+type queue struct {
+	index    *Index
+	wal      *wal
+	interval time.Duration
+
+	lock       sync.Mutex
+	applied    *sync.Cond
+	pending    []*walEntry
+	lastSeq    uint64
+	appliedSeq uint64
+	closed     bool
+	// err is the last error applying the pending documents, failures counts them.
+	err      error
+	failures uint64
+
+	wake chan struct{}
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newQueue(index *Index, path string, interval time.Duration) (*queue, error) {
+	err := index._index.AddBTree(metaIndexName)
+	if err != nil {
+		return nil, err
+	}
+
+	q := new(queue)
+	q.index = index
+	q.interval = interval
+	q.applied = sync.NewCond(&q.lock)
+	q.wake = make(chan struct{}, 1)
+	q.quit = make(chan struct{})
+
+	value, exists, err := index._index.Search(metaIndexName, walAppliedKey)
+	if err != nil {
+		return nil, err
+	} else if exists {
+		q.appliedSeq = xencoding.Bytes2Uint64(value)
+	}
+	q.lastSeq = q.appliedSeq
+
+	var entries []*walEntry
+	q.wal, entries, err = openWAL(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Seq > q.appliedSeq {
+			q.pending = append(q.pending, e)
+		}
+		if e.Seq > q.lastSeq {
+			q.lastSeq = e.Seq
+		}
+	}
+	if len(q.pending) > 0 {
+		logger.Infof("replay %d documents from wal %s.", len(q.pending), path)
+		q.notify()
+	}
+
+	q.wg.Add(1)
+	go q.run()
+	return q, nil
+}
+
+func (q *queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *queue) run() {
+	defer q.wg.Done()
+
+	var tick <-chan time.Time
+	if q.interval > 0 {
+		ticker := time.NewTicker(q.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-q.wake:
+		case <-tick:
+		case <-q.quit:
+			q.applyAll()
+			return
+		}
+		q.applyAll()
+	}
+}
+
+func (q *queue) applyAll() {
+	for q.applyBatch() {
+	}
+}
+
+// applyBatch indexes the oldest pending documents, it returns false if none is pending.
+func (q *queue) applyBatch() bool {
+	q.lock.Lock()
+	n := len(q.pending)
+	if n > queueBatchSize {
+		n = queueBatchSize
+	}
+	entries := q.pending[:n]
+	q.lock.Unlock()
+
+	if n == 0 {
+		return false
+	}
+
+	err := q.index.writer.write(q.applyOp(entries...))
+	if err != nil {
+		// apply one by one, a document that can't be indexed is dropped with a warning
+		// so it doesn't block the queue.
+		for _, e := range entries {
+			if err = q.index.writer.write(q.applyOp(e)); err != nil {
+				logger.Warnf("drop queued document %d %s: %v", e.Seq, e.Doc.PK, err)
+				err = q.index.writer.write(q.appliedOp(e.Seq))
+			}
+			if err != nil {
+				logger.Warnf("queue: %v", err)
+				q.fail(err)
+				return false
+			}
+		}
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.pending = q.pending[n:]
+	q.appliedSeq = entries[n-1].Seq
+	q.err = nil
+	if len(q.pending) == 0 {
+		if err = q.wal.truncate(); err != nil {
+			logger.Warnf("truncate wal: %v", err)
+		}
+	} else if q.wal.size >= walCompactSize {
+		q.compactLocked()
+	}
+	q.applied.Broadcast()
+	return true
+}
+
+// fail wakes the refreshes waiting for the batch that failed with err, the batch is
+// tried again by the next refresh or tick.
+func (q *queue) fail(err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.err = err
+	q.failures++
+	q.applied.Broadcast()
+}
+
+// compactLocked rewrites the wal with the pending records once the applied ones are at
+// least half of it, so it doesn't grow without limit while documents keep coming.
+func (q *queue) compactLocked() {
+	var pending int64
+	for _, e := range q.pending {
+		pending += e.size
+	}
+	if pending > q.wal.size/2 {
+		return
+	}
+	if err := q.wal.rewrite(q.pending); err != nil {
+		logger.Warnf("compact wal: %v", err)
+	}
+}
+
+func (q *queue) applyOp(entries ...*walEntry) writeOp {
+	return func(tx *bolt.Tx, status *bitset.BitSet) error {
+		for _, e := range entries {
+			if err := q.index.addDocumentTx(tx, status, e.Doc); err != nil {
+				return err
+			}
+		}
+		return q.appliedOp(entries[len(entries)-1].Seq)(tx, status)
+	}
+}
+
+func (q *queue) appliedOp(seq uint64) writeOp {
+	return func(tx *bolt.Tx, status *bitset.BitSet) error {
+		return q.index._index.SetTx(tx, metaIndexName, walAppliedKey, xencoding.Uint642Bytes(seq))
+	}
+}
+
+func (q *queue) enqueue(doc *Document) (uint64, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return 0, ErrIndexClosed
+	}
+
+	e := &walEntry{Seq: q.lastSeq + 1, Doc: doc}
+	if err := q.wal.append(e); err != nil {
+		return 0, err
+	}
+	q.lastSeq = e.Seq
+	q.pending = append(q.pending, e)
+	if len(q.pending) >= queueBatchSize || q.interval <= 0 {
+		q.notify()
+	}
+	return e.Seq, nil
+}
+
+// refresh waits until every document enqueued before the call is applied, it returns the
+// error of a batch that fails meanwhile.
+func (q *queue) refresh() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	target, failures := q.lastSeq, q.failures
+	q.notify()
+	for q.appliedSeq < target {
+		if q.closed {
+			return ErrIndexClosed
+		} else if q.failures != failures {
+			return q.err
+		}
+		q.applied.Wait()
+	}
+	return nil
+}
+
+// close applies the pending documents and closes the wal.
+func (q *queue) close() error {
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.lock.Unlock()
+
+	close(q.quit)
+	q.wg.Wait()
+
+	q.lock.Lock()
+	q.applied.Broadcast()
+	q.lock.Unlock()
+
+	return q.wal.close()
+}
+
+// Enqueue writes doc to the write-ahead log and returns its sequence number at once.
+// The document is indexed in the background and becomes searchable after the next
+// refresh: when the queue holds enough documents, every Options.RefreshInterval or
+// when Refresh is called. Documents not indexed yet are replayed when the index is
+// opened again.
+func (index *Index) Enqueue(doc *Document) (uint64, error) {
+	if doc == nil {
+		return 0, fmt.Errorf("document is nil")
+	}
+	if doc.PK == "" {
+		return 0, fmt.Errorf("document pk can't be empty")
+	}
+	return index.queue.enqueue(doc)
+}
+
+// Refresh indexes the enqueued documents and waits until they are searchable. If they
+// can't be written, it returns the error and they stay pending.
+func (index *Index) Refresh() error {
+	return index.queue.refresh()
+}
+
+// Pending returns the number of enqueued documents that are not searchable yet.
+func (index *Index) Pending() int {
+	index.queue.lock.Lock()
+	defer index.queue.lock.Unlock()
+
+	return len(index.queue.pending)
+}
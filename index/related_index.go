@@ -0,0 +1,152 @@
+package index
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/mnhkahn/gods/xsort"
+)
+
+// moreLikeThisTerms is the number of the most distinctive terms of a document queried by
+// MoreLikeThis.
+const moreLikeThisTerms = 25
+
+// MoreLikeThis returns the n documents most related to the document of pk, it isn't one
+// of them. They are ranked by the score of the most distinctive terms of its title, brief
+// and full text, the ones in the fewest documents, and its tags and category. n is
+// DefaultPageSize if it's 0.
+func (index *Index) MoreLikeThis(pk string, n int) (*Result, error) {
+	if n < 0 {
+		return nil, &ParamError{Name: "size", Reason: "can't be negative"}
+	} else if n == 0 {
+		n = DefaultPageSize
+	} else if n > index.opts.MaxPageSize {
+		return nil, &ParamError{Name: "size", Reason: fmt.Sprintf("%d is larger than the max page size %d", n, index.opts.MaxPageSize)}
+	}
+
+	docIds, err := index.SearchPks(pk)
+	if err != nil {
+		return nil, err
+	} else if len(docIds) == 0 {
+		return nil, ErrDocumentNotFound
+	}
+	docId := docIds[0]
+	doc := index.ToDocuments(docId)[0]
+
+	m := new(matches)
+	if m.keywords, err = index.distinctiveTerms(doc); err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"tags", "category"} {
+		f := index.fieldTerms(name, doc)
+		for _, term := range f.terms {
+			ids, exists, err := f.field.SearchBytesUints([]byte(term))
+			if err != nil {
+				return nil, err
+			} else if exists {
+				m.keywords = append(m.keywords, &termPostings{field: name, terms: []string{term}, docIds: ids})
+			}
+		}
+	}
+
+	lists := make([][]uint32, 0, len(m.keywords))
+	for _, p := range m.keywords {
+		lists = append(lists, p.docIds)
+	}
+	candidates := make([]uint32, 0)
+	for _, id := range xsort.MergeOrUints(lists...) {
+		if id != docId && index.status.Test(id) {
+			candidates = append(candidates, id)
+		}
+	}
+
+	scores, err := index.scores(m, candidates)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]int, len(candidates))
+	for i := range keys {
+		keys[i] = i
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if scores[keys[i]] != scores[keys[j]] {
+			return scores[keys[i]] > scores[keys[j]]
+		}
+		return candidates[keys[i]] < candidates[keys[j]]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+
+	page := make([]uint32, 0, len(keys))
+	for _, k := range keys {
+		page = append(page, candidates[k])
+	}
+	res := &Result{Total: len(candidates), Hits: make([]*Hit, 0, len(page))}
+	for i, hit := range index.ToDocuments(page...) {
+		res.Hits = append(res.Hits, &Hit{Document: hit, DocId: page[i], Score: scores[keys[i]]})
+	}
+	return res, nil
+}
+
+// distinctiveTerms returns the postings of the moreLikeThisTerms terms of the title,
+// brief and full text of doc in the fewest documents. A term only doc has is left out,
+// it can't relate doc to another one.
+func (index *Index) distinctiveTerms(doc *Document) ([]*termPostings, error) {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, name := range []string{"title", "brief", "full_text"} {
+		for _, term := range index.fieldTerms(name, doc).terms {
+			if !seen[term] && isWord(term) {
+				seen[term] = true
+				terms = append(terms, term)
+			}
+		}
+	}
+
+	postings, err := index.keywordPostings(terms)
+	if err != nil {
+		return nil, err
+	}
+	byTerm := make(map[string][]*termPostings, len(terms))
+	for _, p := range postings {
+		byTerm[p.terms[0]] = append(byTerm[p.terms[0]], p)
+	}
+
+	df := make(map[string]int, len(byTerm))
+	candidates := make([]string, 0, len(byTerm))
+	for term, ps := range byTerm {
+		lists := make([][]uint32, 0, len(ps))
+		for _, p := range ps {
+			lists = append(lists, p.docIds)
+		}
+		if df[term] = index.liveCount(xsort.MergeOrUints(lists...)); df[term] > 1 {
+			candidates = append(candidates, term)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if df[candidates[i]] != df[candidates[j]] {
+			return df[candidates[i]] < df[candidates[j]]
+		}
+		return candidates[i] < candidates[j]
+	})
+	if len(candidates) > moreLikeThisTerms {
+		candidates = candidates[:moreLikeThisTerms]
+	}
+
+	res := make([]*termPostings, 0, len(candidates))
+	for _, term := range candidates {
+		res = append(res, byTerm[term]...)
+	}
+	return res, nil
+}
+
+// isWord reports whether term has a letter or a digit, the segmenter returns the spaces
+// and the punctuations as terms too.
+func isWord(term string) bool {
+	return strings.IndexFunc(term, func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	}) >= 0
+}
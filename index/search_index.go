@@ -2,19 +2,19 @@ package index
 
 import (
 	"fmt"
+	"sort"
+	"time"
 
-	"github.com/huichen/sego"
 	"github.com/mnhkahn/gods/xsort"
 	"github.com/mnhkahn/gogogo/logger"
 	"github.com/vmihailenco/msgpack"
 )
 
+// DefaultPageSize is the number of documents of MoreLikeThis when n is 0.
+const DefaultPageSize = 10
+
 // Search ...
 func (index *Index) Search(pars *Param) (int, []*Document, error) {
-	if pars.Query == "*" {
-		return index.SearchAll(pars)
-	}
-
 	total, docIds, err := index.SearchDocIds(pars)
 	if err != nil {
 		return 0, nil, err
@@ -24,85 +24,228 @@ func (index *Index) Search(pars *Param) (int, []*Document, error) {
 	return total, docs, nil
 }
 
-// SearchAll search status index for all result.
+// SearchAll search status index for all result, the query and the filters of pars
+// are ignored.
 func (index *Index) SearchAll(pars *Param) (int, []*Document, error) {
-	res, err := index.SearchAllDocIds(true)
+	all := *pars
+	all.Query = "*"
+	all.PKs, all.Tags, all.Category = nil, nil, ""
+	all.TagsAll, all.TagsAny, all.TagsNone = nil, nil, nil
+	all.Categories, all.CategoriesNone = nil, nil
+	return index.Search(&all)
+}
+
+// SearchDocIds ...
+func (index *Index) SearchDocIds(param *Param) (int, []uint32, error) {
+	m, err := index.search(param, nil)
 	if err != nil {
 		return 0, nil, err
 	}
-
-	res = index.SortDocIds(pars, res)
-	res = index.PageSizeDocIds(res, pars.Offset, pars.Size)
-
-	return len(res), index.ToDocuments(res...), nil
+	return m.total, m.page, nil
 }
 
-// SearchDocIds ...
-func (index *Index) SearchDocIds(param *Param) (int, []uint32, error) {
+// search matches param and returns the page of docIds, the steps are recorded in tr
+// if it isn't nil.
+func (index *Index) search(param *Param, tr *tracer) (*matches, error) {
 	if param == nil {
-		return 0, nil, fmt.Errorf("param can't be nil")
+		return nil, fmt.Errorf("param can't be nil")
 	}
 
-	index.CheckParam(param)
+	err := index.CheckParam(param)
+	if err != nil {
+		return nil, err
+	}
 
-	res := make([]uint32, 0)
+	m := new(matches)
 	mergeIds := make([][]uint32, 0, 4)
 
 	if len(param.PKs) > 0 {
 		pkDocIds, err := index.SearchPks(param.PKs...)
 		if err != nil {
-			return 0, nil, err
+			return nil, err
 		}
+		m.filters = append(m.filters, &termPostings{field: "pk", terms: param.PKs, docIds: pkDocIds})
+		tr.add("pk", "", param.PKs, len(pkDocIds))
 		mergeIds = append(mergeIds, pkDocIds)
 	}
 
-	if param.Query != "" {
-		querys := sego.SegmentsToSlice(index.segmenter.Segment([]byte(param.Query)), false)
-		keyWordIds, err := index.SearchKeyWords(querys)
+	if param.Query == "*" {
+		all := index.status.All()
+		tr.add("all", "", nil, len(all))
+		mergeIds = append(mergeIds, all)
+	} else if param.Query != "" {
+		querys, patterns, err := index.parseQuery(param.Query, param.Wildcards)
+		if err != nil {
+			return nil, err
+		}
+		postings, err := index.keywordPostings(querys)
 		if err != nil {
-			return 0, nil, err
+			return nil, err
+		}
+
+		lists := make([][]uint32, 0, len(postings))
+		for _, p := range postings {
+			tr.add("term", p.field, p.terms, len(p.docIds))
+			lists = append(lists, p.docIds)
+		}
+		// a pattern is a term of every field it matches terms in.
+		for _, p := range patterns {
+			expanded, err := index.patternPostings(p, tr)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range expanded {
+				lists = append(lists, e.docIds)
+			}
+			postings = append(postings, expanded...)
+			querys = append(querys, p.expr)
 		}
+		m.keywords = postings
+		keyWordIds := xsort.MergeOrUints(lists...)
+		tr.add("or", "", querys, len(keyWordIds))
 
 		mergeIds = append(mergeIds, keyWordIds)
 	}
 
-	if len(param.Tags) > 0 {
-		tagDocIds, err := index.SearchTag(param.Tags...)
-		if err != nil {
-			return 0, nil, err
+	// the filters that include docIds, then the ones that exclude docIds.
+	var excludes [][]uint32
+	for _, f := range param.termFilters() {
+		terms := f.terms
+		ii := index.tag
+		if f.field == "category" {
+			ii = index.category
 		}
-		mergeIds = append(mergeIds, tagDocIds)
-	}
-
-	if param.Category != "" {
-		categoryDocIds, err := index.SearchCategory(param.Category)
+		docIds, err := index.termsDocIds(ii, terms, f.op == filterAll)
 		if err != nil {
-			return 0, nil, err
+			return nil, err
+		}
+		m.filters = append(m.filters, &termPostings{field: f.field, op: f.op, terms: terms, docIds: docIds})
+		tr.add(f.name(), "", terms, len(docIds))
+		if f.op == filterNone {
+			excludes = append(excludes, docIds)
+		} else {
+			mergeIds = append(mergeIds, docIds)
 		}
-		mergeIds = append(mergeIds, categoryDocIds)
 	}
 
-	res = xsort.MergeAndUints(mergeIds...)
+	if len(mergeIds) == 0 && len(excludes) > 0 {
+		all := index.status.All()
+		tr.add("all", "", nil, len(all))
+		mergeIds = append(mergeIds, all)
+	}
+	res := xsort.MergeAndUints(mergeIds...)
+	tr.add("and", "", nil, len(res))
+	if len(excludes) > 0 {
+		res = excludeUints(res, xsort.MergeOrUints(excludes...))
+		tr.add("not", "", nil, len(res))
+	}
 
-	total := len(res)
+	m.total = len(res)
+	if param.FunctionScore != nil {
+		m.function, m.now = param.FunctionScore, time.Now().Unix()
+		tr.add("function", param.FunctionScore.String(), nil, len(res))
+	}
 	// sort
-	res = index.SortDocIds(param, res)
+	clauses := param.sortClauses()
+	keys, err := index.sortKeys(m, clauses, res)
+	if err != nil {
+		return nil, err
+	}
+	tr.add("sort", sortString(clauses), nil, len(keys))
+	if param.CollapseDuplicates {
+		keys, m.collapsed, err = index.collapseDuplicates(keys)
+		if err != nil {
+			return nil, err
+		}
+		m.total -= m.collapsed
+		tr.add("collapse_duplicates", fmt.Sprintf("distance %d", index.opts.DuplicateDistance), nil, len(keys))
+	}
+	if param.CollapseBy != "" && param.GroupSize > 0 {
+		groups, err := index.groups(param.CollapseBy, keys, param.GroupSize)
+		if err != nil {
+			return nil, err
+		}
+		tr.add("group", param.CollapseBy, nil, len(groups))
+		m.total = len(groups)
+		start, end := pageBounds(len(groups), param.Offset, param.Size)
+		m.groups = groups[start:end]
+		for _, g := range m.groups {
+			m.page = append(m.page, g.docIds...)
+		}
+		tr.add("page", fmt.Sprintf("offset %d size %d", param.Offset, param.Size), nil, len(m.groups))
+		return m, nil
+	} else if param.CollapseBy != "" {
+		if keys, err = index.collapse(m, param.CollapseBy, keys); err != nil {
+			return nil, err
+		}
+		tr.add("collapse", param.CollapseBy, nil, len(keys))
+	}
+	if param.SearchAfter != nil {
+		after := &sortKey{docId: param.SearchAfter.DocId, values: param.SearchAfter.Values}
+		keys = keys[sort.Search(len(keys), func(i int) bool {
+			return compareKeys(keys[i], after, clauses) > 0
+		}):]
+		tr.add("search_after", param.SearchAfter.String(), nil, len(keys))
+	}
 	// page & size
-	res = index.PageSizeDocIds(res, param.Offset, param.Size)
+	start, end := pageBounds(len(keys), param.Offset, param.Size)
+	m.page = make([]uint32, 0, end-start)
+	for _, k := range keys[start:end] {
+		m.page = append(m.page, k.docId)
+	}
+	if end < len(keys) && end > start {
+		m.next = keys[end-1].cursor()
+	}
+	tr.add("page", fmt.Sprintf("offset %d size %d", param.Offset, param.Size), nil, len(m.page))
 
-	return total, res, nil
+	return m, nil
 }
 
 // CheckParam check if param is error.
 // Offset default value is 0.
-// Size default value is 10.
-func (index *Index) CheckParam(param *Param) {
+// Size default value is Options.MaxPageSize, it can't be larger.
+func (index *Index) CheckParam(param *Param) error {
 	if param.Offset < 0 {
-		param.Offset = 0
+		return &ParamError{Name: "offset", Reason: "can't be negative"}
+	}
+	if param.Size < 0 {
+		return &ParamError{Name: "size", Reason: "can't be negative"}
+	} else if param.Size == 0 {
+		param.Size = index.opts.MaxPageSize
+	} else if param.Size > index.opts.MaxPageSize {
+		return &ParamError{Name: "size", Reason: fmt.Sprintf("%d is larger than the max page size %d", param.Size, index.opts.MaxPageSize)}
+	}
+	if param.FunctionScore != nil {
+		if err := param.FunctionScore.validate(); err != nil {
+			return err
+		}
+	}
+	for _, c := range param.SortBy {
+		if err := c.validate(); err != nil {
+			return err
+		}
+	}
+	if param.SearchAfter != nil && len(param.SearchAfter.Values) != len(param.sortClauses()) {
+		return &ParamError{Name: "search_after", Reason: "the cursor doesn't match the sort"}
 	}
-	if param.Size <= 0 || param.Size > 100 {
-		param.Size = 100
+	if param.CollapseBy != "" {
+		if err := validateCollapseBy(param.CollapseBy); err != nil {
+			return err
+		}
 	}
+	if param.GroupSize < 0 {
+		return &ParamError{Name: "group_size", Reason: "can't be negative"}
+	} else if param.GroupSize > 0 {
+		switch {
+		case param.CollapseBy == "":
+			return &ParamError{Name: "group_size", Reason: "needs collapse_by"}
+		case param.GroupSize > index.opts.MaxPageSize:
+			return &ParamError{Name: "group_size", Reason: fmt.Sprintf("%d is larger than the max page size %d", param.GroupSize, index.opts.MaxPageSize)}
+		case param.SearchAfter != nil:
+			return &ParamError{Name: "search_after", Reason: "groups are paged by offset"}
+		}
+	}
+	return nil
 }
 
 // SearchPks ...
@@ -129,74 +272,104 @@ func (index *Index) SearchPks(pks ...string) ([]uint32, error) {
 
 // SearchKeyWords search by keywords. If query is english, it should be lower case.
 func (index *Index) SearchKeyWords(queries []string) ([]uint32, error) {
+	postings, err := index.keywordPostings(queries)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([][]uint32, 0, len(postings))
+	for _, p := range postings {
+		res = append(res, p.docIds)
+	}
+	return xsort.MergeOrUints(res...), nil
+}
+
+// keywordField is a field searched by the query.
+type keywordField struct {
+	name string
+	ii   *InvertIndex
+}
+
+func (index *Index) keywordFields() []keywordField {
+	return []keywordField{{"title", index.title}, {"brief", index.brief}, {"full_text", index.fullText}}
+}
+
+// keywordPostings returns the posting list of every query found in title, brief and
+// full text.
+func (index *Index) keywordPostings(queries []string) ([]*termPostings, error) {
 	if len(queries) == 0 {
 		return nil, nil
 	}
 
-	res := make([][]uint32, 0, len(queries))
+	res := make([]*termPostings, 0, len(queries))
 	for _, query := range queries {
-		// search in title
-		docIds, exists, err := index.title.SearchBytesUints([]byte(query))
-		if err != nil {
-			return nil, err
-		} else if exists {
-			res = append(res, docIds)
-		}
-
-		// search in brief
-		docIds, exists, err = index.brief.SearchBytesUints([]byte(query))
-		if err != nil {
-			return nil, err
-		} else if exists {
-			res = append(res, docIds)
-		}
-
-		// search in full text
-		docIds, exists, err = index.fullText.SearchBytesUints([]byte(query))
-		if err != nil {
-			return nil, err
-		} else if exists {
-			res = append(res, docIds)
+		for _, f := range index.keywordFields() {
+			docIds, exists, err := f.ii.SearchBytesUints([]byte(query))
+			if err != nil {
+				return nil, err
+			} else if exists {
+				res = append(res, &termPostings{field: f.name, terms: []string{query}, docIds: docIds})
+			}
 		}
 	}
 
-	return xsort.MergeOrUints(res...), nil
+	return res, nil
 }
 
-// SearchTag ...
+// SearchTag returns the docIds with any of tags.
 func (index *Index) SearchTag(tags ...string) ([]uint32, error) {
-	if len(tags) == 0 {
+	return index.termsDocIds(index.tag, tags, false)
+}
+
+// SearchTagsAll returns the docIds with all of tags.
+func (index *Index) SearchTagsAll(tags ...string) ([]uint32, error) {
+	return index.termsDocIds(index.tag, tags, true)
+}
+
+// SearchCategory returns the docIds in any of category.
+func (index *Index) SearchCategory(category ...string) ([]uint32, error) {
+	return index.termsDocIds(index.category, category, false)
+}
+
+// termsDocIds returns the sorted docIds of any of terms in ii, or of all of them if all is
+// set. It's nil if terms is empty.
+func (index *Index) termsDocIds(ii *InvertIndex, terms []string, all bool) ([]uint32, error) {
+	if len(terms) == 0 {
 		return nil, nil
 	}
-	res := make([]uint32, 0, len(tags))
-	for _, t := range tags {
-		docIds, exists, err := index.tag.SearchBytesUints([]byte(t))
+	lists := make([][]uint32, 0, len(terms))
+	for _, t := range terms {
+		docIds, exists, err := ii.SearchBytesUints([]byte(t))
 		if err != nil {
-			return res, err
+			return nil, err
 		} else if exists {
-			res = append(res, docIds...)
-			xsort.UInt32s(res)
+			lists = append(lists, docIds)
+		} else if all {
+			return []uint32{}, nil
 		}
 	}
-	return res, nil
+	if len(lists) == 0 {
+		return []uint32{}, nil
+	} else if all {
+		return xsort.MergeAndUints(lists...), nil
+	}
+	return xsort.MergeOrUints(lists...), nil
 }
 
-// SearchCategory ...
-func (index *Index) SearchCategory(category ...string) ([]uint32, error) {
-	if len(category) == 0 {
-		return nil, nil
-	}
-	res := make([]uint32, 0, len(category))
-	for _, t := range category {
-		docIds, exists, err := index.category.SearchBytesUints([]byte(t))
-		if err != nil {
-			return res, err
-		} else if exists {
-			res = append(res, docIds...)
-			xsort.UInt32s(res)
+// excludeUints returns the docIds of a that aren't in b, both are sorted.
+func excludeUints(a, b []uint32) []uint32 {
+	res := make([]uint32, 0, len(a))
+	j := 0
+	for _, docId := range a {
+		for j < len(b) && b[j] < docId {
+			j++
+		}
+		if j < len(b) && b[j] == docId {
+			continue
 		}
+		res = append(res, docId)
 	}
-	return res, nil
+	return res
 }
 
 // SearchDocIds ...
@@ -204,7 +377,19 @@ func (index *Index) SearchAllDocIds(status bool) ([]uint32, error) {
 	return index.status.Uints(status), nil
 }
 
+// LiveDocIds returns at most size live docIds from from on, in order. The next page is
+// from the last docId returned plus one.
+func (index *Index) LiveDocIds(from uint32, size int) []uint32 {
+	return index.status.SetFrom(from, size)
+}
+
+// Count returns the number of live documents.
+func (index *Index) Count() int {
+	return int(index.status.Len())
+}
+
 // ToDocuments ...
+// The pv of a document is its counter, see IncrPV.
 func (index *Index) ToDocuments(docIds ...uint32) []*Document {
 	res := make([]*Document, 0, len(docIds))
 	for _, docId := range docIds {
@@ -217,22 +402,32 @@ func (index *Index) ToDocuments(docIds ...uint32) []*Document {
 		res = append(res, d)
 	}
 
+	pvs, err := index.docValuesOf("pv", docIds)
+	if err != nil {
+		logger.Warnf("pv of documents: %v.", err)
+		return res
+	}
+	for i, pv := range pvs {
+		if pv != nil {
+			res[i].PV = int(decodeInt(pv))
+		}
+	}
 	return res
 }
 
 // PageSizeDocIds ...
 func (index *Index) PageSizeDocIds(docIds []uint32, offset, size int) []uint32 {
-	le := len(docIds)
-	if le <= 1 {
-		return docIds
-	}
+	start, end := pageBounds(len(docIds), offset, size)
+	return docIds[start:end]
+}
 
-	if offset < le {
-		if offset+size <= le {
-			return docIds[offset : offset+size]
-		} else {
-			return docIds[offset:]
-		}
+// pageBounds returns the slice bounds of the page at offset in n results.
+func pageBounds(n, offset, size int) (int, int) {
+	if offset >= n {
+		return n, n
+	}
+	if offset+size > n {
+		return offset, n
 	}
-	return []uint32{}
+	return offset, offset + size
 }
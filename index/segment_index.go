@@ -0,0 +1,48 @@
+package index
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/huichen/sego"
+)
+
+var (
+	segmentersLock sync.Mutex
+	// segmenters caches the loaded dictionaries, sego.Segmenter is safe for concurrent use
+	// so the indexes sharing a dictionary share the segmenter.
+	segmenters = make(map[string]*sego.Segmenter)
+)
+
+// loadSegmenter loads the sego dictionary files, separated by comma.
+// sego exits the process on a missing file, so every file is checked first.
+func loadSegmenter(dictionary string) (*sego.Segmenter, error) {
+	if dictionary == "" {
+		return nil, fmt.Errorf("dictionary can't be empty")
+	}
+
+	segmentersLock.Lock()
+	defer segmentersLock.Unlock()
+
+	if seg, ok := segmenters[dictionary]; ok {
+		return seg, nil
+	}
+
+	for _, file := range strings.Split(dictionary, ",") {
+		if _, err := os.Stat(file); err != nil {
+			return nil, fmt.Errorf("dictionary: %s", err)
+		}
+	}
+
+	seg := new(sego.Segmenter)
+	seg.LoadDictionary(dictionary)
+	segmenters[dictionary] = seg
+	return seg, nil
+}
+
+// segment splits text into terms.
+func (index *Index) segment(text string) []string {
+	return sego.SegmentsToSlice(index.segmenter.Segment([]byte(text)), index.opts.SearchMode)
+}
@@ -0,0 +1,400 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/mnhkahn/gods/xencoding"
+	"github.com/mnhkahn/gogogo/logger"
+	"github.com/vmihailenco/msgpack"
+	"github.com/willf/bitset"
+)
+
+// Policies of Options.Duplicates, what AddDocument does with a new pk whose full text is a
+// near duplicate of a stored document.
+const (
+	// DuplicatesAllow indexes it as any other document.
+	DuplicatesAllow = ""
+	// DuplicatesReject skips it, AddDocuments returns a *RejectedError.
+	DuplicatesReject = "reject"
+	// DuplicatesMerge adds its tags, pv and the fields the stored document lacks to the
+	// stored document, the pk isn't indexed. The pv of a pk merged again replaces the one
+	// added before.
+	DuplicatesMerge = "merge"
+)
+
+// MaxDuplicateDistance is the largest Options.DuplicateDistance. A fingerprint is indexed
+// by MaxDuplicateDistance+1 bands of 16 bits, a near duplicate shares one of them.
+const MaxDuplicateDistance = 3
+
+// DefaultDuplicateDistance is the Hamming distance of near duplicates when
+// Options.DuplicateDistance is 0.
+const DefaultDuplicateDistance = 3
+
+// simHashIndexName is the bucket of the fingerprint bands, | band | 16 bits | => docIds.
+// The fingerprints are stored in DocValues as simHashField. They are derived from the
+// documents and rebuilt on open if the bucket is empty.
+var simHashIndexName = []byte("SimHash")
+
+const simHashField = "simhash"
+
+// mergedIndexName is the bucket of the pks merged into a document and their pv,
+// | pk | 0 | merged pk | => pv. It's removed with the document.
+var mergedIndexName = []byte("Merged")
+
+// DuplicateError is returned by AddDocument if the document is a near duplicate and
+// Options.Duplicates is DuplicatesReject.
+type DuplicateError struct {
+	PK       string `json:"pk"`
+	Of       string `json:"of"`
+	Distance int    `json:"distance"`
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("document %s is a near duplicate of %s, distance %d", e.PK, e.Of, e.Distance)
+}
+
+// RejectedError is returned by AddDocuments if some of the documents are near duplicates
+// and Options.Duplicates is DuplicatesReject, the other documents are indexed.
+type RejectedError struct {
+	Duplicates []*DuplicateError
+}
+
+func (e *RejectedError) Error() string {
+	if len(e.Duplicates) == 1 {
+		return e.Duplicates[0].Error()
+	}
+	return fmt.Sprintf("%d documents are near duplicates, %s", len(e.Duplicates), e.Duplicates[0])
+}
+
+// Duplicate is a near duplicate of a document.
+type Duplicate struct {
+	*Document
+	DocId uint32 `json:"doc_id"`
+	// Distance is the Hamming distance of the fingerprints, 0 is the same full text.
+	Distance int `json:"distance"`
+}
+
+// nearDuplicate is a docId within the distance of a fingerprint.
+type nearDuplicate struct {
+	docId    uint32
+	distance int
+}
+
+func checkDuplicateOptions(opts *Options) error {
+	switch opts.Duplicates {
+	case DuplicatesAllow, DuplicatesReject, DuplicatesMerge:
+	default:
+		return fmt.Errorf("duplicates is %q or %q: %s", DuplicatesReject, DuplicatesMerge, opts.Duplicates)
+	}
+	if opts.DuplicateDistance < 0 || opts.DuplicateDistance > MaxDuplicateDistance {
+		return fmt.Errorf("duplicate distance is in [0, %d]: %d", MaxDuplicateDistance, opts.DuplicateDistance)
+	} else if opts.DuplicateDistance == 0 {
+		opts.DuplicateDistance = DefaultDuplicateDistance
+	}
+	return nil
+}
+
+// simHash returns the 64 bits SimHash of the words of the full text of doc, false if it
+// has none.
+func (index *Index) simHash(doc *Document) (uint64, bool) {
+	counts := make(map[string]int)
+	for _, term := range index.segment(doc.FullText) {
+		if isWord(term) {
+			counts[strings.ToLower(term)]++
+		}
+	}
+	if len(counts) == 0 {
+		return 0, false
+	}
+
+	var v [64]int
+	for term, n := range counts {
+		h := fnv.New64a()
+		h.Write([]byte(term))
+		sum := h.Sum64()
+		for i := range v {
+			if sum&(1<<uint(i)) != 0 {
+				v[i] += n
+			} else {
+				v[i] -= n
+			}
+		}
+	}
+	var fp uint64
+	for i := range v {
+		if v[i] > 0 {
+			fp |= 1 << uint(i)
+		}
+	}
+	return fp, true
+}
+
+// simHashBands returns the band keys of fp.
+func simHashBands(fp uint64) [][]byte {
+	res := make([][]byte, 0, MaxDuplicateDistance+1)
+	for i := 0; i <= MaxDuplicateDistance; i++ {
+		band := uint16(fp >> (16 * uint(i)))
+		res = append(res, []byte{byte(i), byte(band >> 8), byte(band)})
+	}
+	return res
+}
+
+// setSimHashTx replaces the fingerprint of docId by the one of doc.
+func (index *Index) setSimHashTx(tx *bolt.Tx, docId uint32, doc *Document) error {
+	if err := index.deleteSimHashTx(tx, docId); err != nil {
+		return err
+	}
+	fp, ok := index.simHash(doc)
+	if !ok {
+		return nil
+	}
+	for _, band := range simHashBands(fp) {
+		if err := index.simHashes.AppendBytesUintsTx(tx, band, docId); err != nil {
+			return err
+		}
+	}
+	return index._index.SetTx(tx, docValuesIndexName, docValueKey(simHashField, docId), xencoding.Uint642Bytes(fp))
+}
+
+func (index *Index) deleteSimHashTx(tx *bolt.Tx, docId uint32) error {
+	key := docValueKey(simHashField, docId)
+	v, exists, err := index._index.SearchTx(tx, docValuesIndexName, key)
+	if err != nil || !exists {
+		return err
+	}
+	for _, band := range simHashBands(xencoding.Bytes2Uint64(v)) {
+		if err = index.simHashes.DeleteBytesUintsTx(tx, band, docId); err != nil {
+			return err
+		}
+	}
+	return index._index.DeleteTx(tx, docValuesIndexName, key)
+}
+
+// nearDuplicatesTx returns the docIds within distance of fp but self, the nearest first.
+func (index *Index) nearDuplicatesTx(tx *bolt.Tx, fp uint64, distance int, self uint32) ([]*nearDuplicate, error) {
+	seen := map[uint32]bool{self: true}
+	var res []*nearDuplicate
+	values := tx.Bucket(docValuesIndexName)
+	for _, band := range simHashBands(fp) {
+		docIds, _, err := index.simHashes.SearchBytesUintsTx(tx, band)
+		if err != nil {
+			return nil, err
+		}
+		for _, docId := range docIds {
+			if seen[docId] {
+				continue
+			}
+			seen[docId] = true
+			v := values.Get(docValueKey(simHashField, docId))
+			if v == nil {
+				continue
+			}
+			if d := bits.OnesCount64(fp ^ xencoding.Bytes2Uint64(v)); d <= distance {
+				res = append(res, &nearDuplicate{docId: docId, distance: d})
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].distance != res[j].distance {
+			return res[i].distance < res[j].distance
+		}
+		return res[i].docId < res[j].docId
+	})
+	return res, nil
+}
+
+// duplicateTx applies Options.Duplicates to doc, a new pk. It returns the document to
+// index instead of doc and its docId, or ok false to index doc.
+func (index *Index) duplicateTx(tx *bolt.Tx, doc *Document) (docId uint32, merged *Document, ok bool, err error) {
+	fp, hasFp := index.simHash(doc)
+	if !hasFp {
+		return 0, nil, false, nil
+	}
+	dups, err := index.nearDuplicatesTx(tx, fp, index.opts.DuplicateDistance, ^uint32(0))
+	if err != nil || len(dups) == 0 {
+		return 0, nil, false, err
+	}
+	of, err := index.documentTx(tx, dups[0].docId)
+	if err != nil || of == nil {
+		return 0, nil, false, err
+	}
+
+	if index.opts.Duplicates == DuplicatesReject {
+		return 0, nil, false, &DuplicateError{PK: doc.PK, Of: of.PK, Distance: dups[0].distance}
+	}
+	logger.Infof("merge near duplicate %s into %s, distance %d", doc.PK, of.PK, dups[0].distance)
+	pv, _, err := index._index.SearchTx(tx, docValuesIndexName, docValueKey("pv", dups[0].docId))
+	if err != nil {
+		return 0, nil, false, err
+	}
+	of.PV = int(decodeInt(pv))
+	merged = mergeDuplicate(of, doc)
+
+	// the pv merged before for the pk is replaced, re-adding it doesn't count it twice.
+	key := mergedKey(of.PK, doc.PK)
+	if counted := tx.Bucket(mergedIndexName).Get(key); counted != nil {
+		merged.PV -= int(decodeInt(counted))
+	}
+	if err = index._index.SetTx(tx, mergedIndexName, key, encodeInt(int64(doc.PV))); err != nil {
+		return 0, nil, false, err
+	}
+	return dups[0].docId, merged, true, nil
+}
+
+func mergedKey(pk, merged string) []byte {
+	return []byte(pk + "\x00" + merged)
+}
+
+// deleteMergedTx forgets the pks merged into the document pk.
+func (index *Index) deleteMergedTx(tx *bolt.Tx, pk string) error {
+	prefix := mergedKey(pk, "")
+	c := tx.Bucket(mergedIndexName).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeDuplicate returns of with the tags and pv of dup added, and the empty fields set by
+// dup. The earliest pub_date is kept.
+func mergeDuplicate(of, dup *Document) *Document {
+	res := *of
+	res.Tags = append([]string(nil), of.Tags...)
+	has := make(map[string]bool, len(of.Tags))
+	for _, tag := range of.Tags {
+		has[strings.ToLower(tag)] = true
+	}
+	for _, tag := range dup.Tags {
+		if !has[strings.ToLower(tag)] {
+			has[strings.ToLower(tag)] = true
+			res.Tags = append(res.Tags, tag)
+		}
+	}
+
+	for _, f := range []struct {
+		dst *string
+		src string
+	}{
+		{&res.Title, dup.Title}, {&res.Brief, dup.Brief}, {&res.Category, dup.Category},
+		{&res.Link, dup.Link}, {&res.Figure, dup.Figure},
+	} {
+		if *f.dst == "" {
+			*f.dst = f.src
+		}
+	}
+	if res.PubDate == 0 || (dup.PubDate != 0 && dup.PubDate < res.PubDate) {
+		res.PubDate = dup.PubDate
+	}
+	res.PV += dup.PV
+	return &res
+}
+
+// collapseDuplicates keeps the first of the near duplicates in keys, it returns the
+// kept keys and the number of the others.
+func (index *Index) collapseDuplicates(keys []*sortKey) ([]*sortKey, int, error) {
+	docIds := make([]uint32, len(keys))
+	for i, k := range keys {
+		docIds[i] = k.docId
+	}
+	fps, err := index.readDocValues(simHashField, docIds)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	kept := make(map[string][]uint64)
+	res := make([]*sortKey, 0, len(keys))
+	for i, k := range keys {
+		if fps[i] == nil {
+			res = append(res, k)
+			continue
+		}
+		fp := xencoding.Bytes2Uint64(fps[i])
+		bands := simHashBands(fp)
+		dup := false
+		for _, band := range bands {
+			for _, other := range kept[string(band)] {
+				if bits.OnesCount64(fp^other) <= index.opts.DuplicateDistance {
+					dup = true
+					break
+				}
+			}
+			if dup {
+				break
+			}
+		}
+		if dup {
+			continue
+		}
+		for _, band := range bands {
+			kept[string(band)] = append(kept[string(band)], fp)
+		}
+		res = append(res, k)
+	}
+	return res, len(keys) - len(res), nil
+}
+
+// NearDuplicates returns the documents whose full text is within
+// Options.DuplicateDistance of the one of pk, the nearest first.
+func (index *Index) NearDuplicates(pk string) ([]*Duplicate, error) {
+	docIds, err := index.SearchPks(pk)
+	if err != nil {
+		return nil, err
+	} else if len(docIds) == 0 {
+		return nil, ErrDocumentNotFound
+	}
+
+	var dups []*nearDuplicate
+	err = index._index.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(docValuesIndexName).Get(docValueKey(simHashField, docIds[0]))
+		if v == nil {
+			return nil
+		}
+		dups, err = index.nearDuplicatesTx(tx, xencoding.Bytes2Uint64(v), index.opts.DuplicateDistance, docIds[0])
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint32, 0, len(dups))
+	for _, d := range dups {
+		ids = append(ids, d.docId)
+	}
+	res := make([]*Duplicate, 0, len(dups))
+	for i, doc := range index.ToDocuments(ids...) {
+		res = append(res, &Duplicate{Document: doc, DocId: dups[i].docId, Distance: dups[i].distance})
+	}
+	return res, nil
+}
+
+// buildSimHashes writes the fingerprint of every live document if the bucket is empty,
+// e.g. the index was created before the fingerprints were.
+func (index *Index) buildSimHashes() error {
+	if index._index.Len(simHashIndexName) > 0 || index.status.Len() == 0 {
+		return nil
+	}
+
+	logger.Infof("build fingerprints of %d documents.", index.status.Len())
+	return index.writer.write(func(tx *bolt.Tx, status *bitset.BitSet) error {
+		return tx.Bucket(documentIndexName).ForEach(func(k, v []byte) error {
+			docId := xencoding.Bytes2Uint(k)
+			if !status.Test(uint(docId)) {
+				return nil
+			}
+			doc := new(Document)
+			if err := msgpack.Unmarshal(v, doc); err != nil {
+				logger.Warnf("fingerprint of document %d: %v", docId, err)
+				return nil
+			}
+			return index.setSimHashTx(tx, docId, doc)
+		})
+	})
+}
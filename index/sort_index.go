@@ -2,8 +2,14 @@
 package index
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
 	"sort"
 	"strings"
+
+	"github.com/mnhkahn/gogogo/logger"
 )
 
 const (
@@ -11,34 +17,206 @@ const (
 	DESC = false
 )
 
-type indexSort struct {
-	sort   Sorter
-	docIds []uint32
-	_index *Index
+// Missing-value policies of a SortClause.
+const (
+	MissingLast  = "last"
+	MissingFirst = "first"
+)
+
+// SortClause is a key of a sort: SortByScore or one of SortFields, its direction and
+// where the documents without a value go, MissingLast by default.
+type SortClause struct {
+	Field   string `json:"field"`
+	Asc     bool   `json:"asc"`
+	Missing string `json:"missing,omitempty"`
+}
+
+// String returns e.g. "pub_date desc" or "title asc missing first".
+func (c SortClause) String() string {
+	s := c.Field + " desc"
+	if c.Asc {
+		s = c.Field + " asc"
+	}
+	if c.Missing == MissingFirst {
+		s += " missing first"
+	}
+	return s
 }
 
-// Len ...
-func (is indexSort) Len() int {
-	return len(is.docIds)
+// validate checks the field and the missing-value policy of c.
+func (c SortClause) validate() error {
+	if c.Missing != "" && c.Missing != MissingLast && c.Missing != MissingFirst {
+		return &ParamError{Name: "sort", Reason: fmt.Sprintf("missing of %s is %s or %s", c.Field, MissingFirst, MissingLast)}
+	}
+	if c.Field == SortByScore {
+		return nil
+	}
+	for _, f := range SortFields {
+		if c.Field == f {
+			return nil
+		}
+	}
+	return &ParamError{Name: "sort", Reason: fmt.Sprintf("unknown field %s, it's %s or one of %v", c.Field, SortByScore, SortFields)}
 }
 
-// Less ...
-func (is indexSort) Less(i, j int) bool {
-	docs := is._index.ToDocuments(is.docIds[i], is.docIds[j])
-	a := docs[0]
-	b := docs[1]
+// ParseSort parses clauses separated by comma, each is field[:asc|desc][:first|last],
+// e.g. "pub_date:desc,title:asc:first". The direction defaults to desc.
+func ParseSort(s string) ([]SortClause, error) {
+	var clauses []SortClause
+	for _, part := range strings.Split(s, ",") {
+		tokens := strings.Split(strings.TrimSpace(part), ":")
+		c := SortClause{Field: strings.ToLower(tokens[0])}
+		for _, t := range tokens[1:] {
+			switch strings.ToLower(t) {
+			case "asc":
+				c.Asc = ASC
+			case "desc":
+				c.Asc = DESC
+			case MissingFirst, MissingLast:
+				c.Missing = strings.ToLower(t)
+			default:
+				return nil, &ParamError{Name: "sort", Reason: fmt.Sprintf("unknown option %s of %s", t, c.Field)}
+			}
+		}
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, c)
+	}
+	return clauses, nil
+}
 
-	switch strings.ToLower(is.sort.Field) {
+// SetSort sorts param by s: a list of clauses parsed by ParseSort if s has a ':' or a ','
+// or is pk or title, else the Sorter of field s and asc.
+func (param *Param) SetSort(s string, asc bool) error {
+	if !strings.ContainsAny(s, ":,") && s != "pk" && s != "title" {
+		param.Sort = Sorter{Field: s, Asc: asc}
+		return nil
+	}
+
+	clauses, err := ParseSort(s)
+	if err != nil {
+		return err
+	}
+	param.SortBy = clauses
+	return nil
+}
+
+// clauses returns the keys of s, the ties are broken by pk in the other direction. A
+// missing pub_date is the smallest one. The clauses of Param.SortBy are the only keys.
+func (s Sorter) clauses() []SortClause {
+	pk := SortClause{Field: "pk", Asc: !s.Asc}
+
+	switch strings.ToLower(s.Field) {
+	case SortByScore:
+		return []SortClause{{Field: SortByScore, Asc: s.Asc}}
 	case "pv":
-		return If(a.PV == b.PV, func() bool { return a.PK > b.PK }, func() bool { return a.PV < b.PV })
-	default:
-		return If(a.PubDate == b.PubDate, func() bool { return a.PK > b.PK }, func() bool { return a.PubDate < b.PubDate })
+		return []SortClause{{Field: "pv", Asc: s.Asc}, pk}
+	}
+	missing := MissingLast
+	if s.Asc {
+		missing = MissingFirst
 	}
+	return []SortClause{{Field: "pub_date", Asc: s.Asc, Missing: missing}, pk}
 }
 
-// Swap ...
-func (is indexSort) Swap(i, j int) {
-	is.docIds[i], is.docIds[j] = is.docIds[j], is.docIds[i]
+// String returns the field and the direction, e.g. "pub_date desc".
+func (s Sorter) String() string {
+	return s.clauses()[0].String()
+}
+
+// sortClauses returns Param.SortBy, or the clauses of Param.Sort if it's empty. A param
+// with a FunctionScore and no sort is sorted by score.
+func (param *Param) sortClauses() []SortClause {
+	if len(param.SortBy) > 0 {
+		return param.SortBy
+	}
+	if param.FunctionScore != nil && param.Sort.Field == "" {
+		return []SortClause{{Field: SortByScore, Asc: param.Sort.Asc}}
+	}
+	return param.Sort.clauses()
+}
+
+// sortString joins the clauses, e.g. "pub_date desc, pk asc".
+func sortString(clauses []SortClause) string {
+	res := make([]string, 0, len(clauses))
+	for _, c := range clauses {
+		res = append(res, c.String())
+	}
+	return strings.Join(res, ", ")
+}
+
+// sortKey is the values of the sort clauses of a docId, they're encoded so that
+// bytes.Compare orders them.
+type sortKey struct {
+	docId  uint32
+	values [][]byte
+}
+
+func (k *sortKey) cursor() *Cursor {
+	return &Cursor{Values: k.values, DocId: k.docId}
+}
+
+// compareKeys compares a and b by clauses, then by docId. A missing value is nil.
+func compareKeys(a, b *sortKey, clauses []SortClause) int {
+	for i, c := range clauses {
+		av, bv := a.values[i], b.values[i]
+		if (av == nil) != (bv == nil) {
+			if (av == nil) == (c.Missing == MissingFirst) {
+				return -1
+			}
+			return 1
+		}
+
+		r := bytes.Compare(av, bv)
+		if !c.Asc {
+			r = -r
+		}
+		if r != 0 {
+			return r
+		}
+	}
+	switch {
+	case a.docId < b.docId:
+		return -1
+	case a.docId > b.docId:
+		return 1
+	}
+	return 0
+}
+
+// sortKeys returns the sorted keys of docIds, the values are read from the doc values.
+func (index *Index) sortKeys(m *matches, clauses []SortClause, docIds []uint32) ([]*sortKey, error) {
+	keys := make([]*sortKey, len(docIds))
+	for i, docId := range docIds {
+		keys[i] = &sortKey{docId: docId, values: make([][]byte, len(clauses))}
+	}
+
+	for i, c := range clauses {
+		if c.Field == SortByScore {
+			scores, err := index.scores(m, docIds)
+			if err != nil {
+				return nil, err
+			}
+			for j, k := range keys {
+				k.values[i] = encodeFloat(scores[j])
+			}
+			continue
+		}
+
+		values, err := index.docValuesOf(c.Field, docIds)
+		if err != nil {
+			return nil, err
+		}
+		for j, k := range keys {
+			k.values[i] = values[j]
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return compareKeys(keys[i], keys[j], clauses) < 0
+	})
+	return keys, nil
 }
 
 // SortDocIds ...
@@ -47,15 +225,37 @@ func (index *Index) SortDocIds(param *Param, docIds []uint32) []uint32 {
 		return docIds
 	}
 
-	if param.Sort.Asc {
-		sort.Sort(indexSort{param.Sort, docIds, index})
-	} else {
-		sort.Sort(sort.Reverse(indexSort{param.Sort, docIds, index}))
+	keys, err := index.sortKeys(new(matches), param.sortClauses(), docIds)
+	if err != nil {
+		logger.Warnf("sort %v: %v", docIds, err)
+		return docIds
+	}
+	for i, k := range keys {
+		docIds[i] = k.docId
 	}
-
 	return docIds
 }
 
+// encodeInt flips the sign bit so that negative numbers are ordered first.
+func encodeInt(v int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v)^1<<63)
+	return b
+}
+
+// encodeFloat flips the sign bit of a positive number and every bit of a negative one.
+func encodeFloat(f float64) []byte {
+	bits := math.Float64bits(f)
+	if bits&(1<<63) == 0 {
+		bits ^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, bits)
+	return b
+}
+
 // If ...
 // https://my.oschina.net/chai2010/blog/202870
 func If(expr bool, f1, f2 func() bool) bool {
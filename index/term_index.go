@@ -0,0 +1,159 @@
+package index
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/mnhkahn/gods/xencoding"
+)
+
+var ErrTermNotFound = errors.New("term not found")
+
+// Fields are the names of the inverted fields, the json names of Document.
+var Fields = []string{"pk", "title", "brief", "full_text", "tags", "category"}
+
+const (
+	// DefaultTermsLimit is the number of terms returned by Terms when limit is 0.
+	DefaultTermsLimit = 100
+	// MaxTermsLimit is the largest limit of Terms.
+	MaxTermsLimit = 1000
+)
+
+// FieldError reports a field that isn't one of Fields.
+type FieldError struct {
+	Field string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("unknown field %s, it's one of %v", e.Field, Fields)
+}
+
+// TermStat is a term of a field and its document frequency.
+type TermStat struct {
+	Term string `json:"term"`
+	// DocFreq is the number of live documents that have the term.
+	DocFreq int `json:"doc_freq"`
+	// Postings is the length of the posting list, dead docIds included.
+	Postings int `json:"postings"`
+}
+
+// TermInfo is a term of a field and its posting list.
+type TermInfo struct {
+	TermStat
+	Field string `json:"field"`
+	// DocIds are the live documents of the posting list, DeadDocIds are the others.
+	DocIds     []uint32 `json:"doc_ids"`
+	DeadDocIds []uint32 `json:"dead_doc_ids,omitempty"`
+	// PKs are the pks of DocIds.
+	PKs []string `json:"pks"`
+}
+
+// field returns the inverted index of the field name, name is one of Fields.
+func (index *Index) field(name string) (*InvertIndex, error) {
+	switch name {
+	case "pk":
+		return index.pk, nil
+	case "title":
+		return index.title, nil
+	case "brief":
+		return index.brief, nil
+	case "full_text":
+		return index.fullText, nil
+	case "tags":
+		return index.tag, nil
+	case "category":
+		return index.category, nil
+	}
+	return nil, &FieldError{Field: name}
+}
+
+// Terms returns the terms of field in order with their document frequency, at most limit
+// of them. Only the terms starting with prefix and greater than after are returned, pass
+// the last term returned as after to get the next page.
+func (index *Index) Terms(field, prefix, after string, limit int) ([]*TermStat, error) {
+	ii, err := index.field(field)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = DefaultTermsLimit
+	} else if limit > MaxTermsLimit {
+		limit = MaxTermsLimit
+	}
+
+	res := make([]*TermStat, 0, limit)
+	err = index._index.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(ii.btname).Cursor()
+
+		k, v := c.Seek([]byte(prefix))
+		if after != "" && after >= prefix {
+			k, v = c.Seek([]byte(after))
+			if k != nil && string(k) == after {
+				k, v = c.Next()
+			}
+		}
+		for ; k != nil && bytes.HasPrefix(k, []byte(prefix)) && len(res) < limit; k, v = c.Next() {
+			docIds := xencoding.Bytes2Uints(v)
+			res = append(res, &TermStat{Term: string(k), DocFreq: index.liveCount(docIds), Postings: len(docIds)})
+		}
+		return nil
+	})
+	return res, err
+}
+
+// Term returns the posting list of term in field, or ErrTermNotFound.
+func (index *Index) Term(field, term string) (*TermInfo, error) {
+	ii, err := index.field(field)
+	if err != nil {
+		return nil, err
+	}
+
+	docIds, exists, err := ii.SearchBytesUints([]byte(term))
+	if err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, ErrTermNotFound
+	}
+
+	info := &TermInfo{Field: field, DocIds: []uint32{}}
+	info.Term = term
+	info.Postings = len(docIds)
+	for _, docId := range docIds {
+		if index.status.Test(docId) {
+			info.DocIds = append(info.DocIds, docId)
+		} else {
+			info.DeadDocIds = append(info.DeadDocIds, docId)
+		}
+	}
+	info.DocFreq = len(info.DocIds)
+	for _, doc := range index.ToDocuments(info.DocIds...) {
+		info.PKs = append(info.PKs, doc.PK)
+	}
+	return info, nil
+}
+
+func (index *Index) liveCount(docIds []uint32) int {
+	n := 0
+	for _, docId := range docIds {
+		if index.status.Test(docId) {
+			n++
+		}
+	}
+	return n
+}
+
+// ForEachTerm calls fn with every term of field in order and its posting list, until fn
+// returns an error. fn runs in a read transaction, it mustn't use the index.
+func (index *Index) ForEachTerm(field string, fn func(term string, docIds []uint32) error) error {
+	ii, err := index.field(field)
+	if err != nil {
+		return err
+	}
+	return index._index.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(ii.btname).ForEach(func(k, v []byte) error {
+			return fn(string(k), xencoding.Bytes2Uints(v))
+		})
+	})
+}
@@ -0,0 +1,157 @@
+package index
+
+import (
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/mnhkahn/gogogo/logger"
+	"github.com/vmihailenco/msgpack"
+	"github.com/willf/bitset"
+)
+
+// DocumentPatch is a partial update of a document, a nil field is left as it is. The pk
+// can't be changed.
+type DocumentPatch struct {
+	Title    *string   `json:"title"`
+	PubDate  *int64    `json:"pub_date"`
+	Brief    *string   `json:"brief"`
+	FullText *string   `json:"full_text"`
+	Tags     *[]string `json:"tags"`
+	Category *string   `json:"category"`
+	Link     *string   `json:"link"`
+	Figure   *string   `json:"figure"`
+	// PV replaces the pv counter, see IncrPV.
+	PV *int `json:"pv"`
+}
+
+// apply merges p into doc and returns the names of termFields it changed.
+func (p *DocumentPatch) apply(doc *Document) []string {
+	var changed []string
+	setString := func(name string, dst *string, src *string) {
+		if src != nil && *dst != *src {
+			*dst = *src
+			changed = append(changed, name)
+		}
+	}
+	setString("title", &doc.Title, p.Title)
+	setString("brief", &doc.Brief, p.Brief)
+	setString("full_text", &doc.FullText, p.FullText)
+	if p.Tags != nil {
+		doc.Tags = append([]string(nil), *p.Tags...)
+		changed = append(changed, "tags")
+	}
+	setString("category", &doc.Category, p.Category)
+
+	if p.PubDate != nil {
+		doc.PubDate = *p.PubDate
+	}
+	if p.Link != nil {
+		doc.Link = *p.Link
+	}
+	if p.Figure != nil {
+		doc.Figure = *p.Figure
+	}
+	if p.PV != nil {
+		doc.PV = *p.PV
+	}
+	return changed
+}
+
+// UpdateDocument merges patch into the document of pk and returns it. Only the postings
+// of the changed fields are updated, the other fields aren't segmented again.
+func (index *Index) UpdateDocument(pk string, patch *DocumentPatch) (*Document, error) {
+	if patch == nil {
+		patch = new(DocumentPatch)
+	}
+
+	var docId uint32
+	err := index.writer.write(func(tx *bolt.Tx, status *bitset.BitSet) (err error) {
+		docId, err = index.updateDocumentTx(tx, pk, patch)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if patch.PV != nil {
+		// the views counted before the patch don't add to its pv.
+		index.counters.forget(pk)
+	}
+	return index.ToDocuments(docId)[0], nil
+}
+
+func (index *Index) updateDocumentTx(tx *bolt.Tx, pk string, patch *DocumentPatch) (uint32, error) {
+	docIds, exists, err := index.pk.SearchBytesUintsTx(tx, []byte(pk))
+	if err != nil {
+		return 0, err
+	} else if !exists || len(docIds) == 0 {
+		return 0, ErrDocumentNotFound
+	}
+	docId := docIds[0]
+
+	old, err := index.documentTx(tx, docId)
+	if err != nil {
+		return 0, err
+	} else if old == nil {
+		return 0, fmt.Errorf("document %s can't be decoded, add it again", pk)
+	}
+	doc := *old
+	changed := patch.apply(&doc)
+	logger.Infof("update document doc: %d, %v, %v", docId, pk, changed)
+
+	for _, name := range changed {
+		oldTerms, newTerms := index.fieldTerms(name, old), index.fieldTerms(name, &doc)
+		err = oldTerms.field.deleteTermsTx(tx, oldTerms.terms, newTerms.terms, docId)
+		if err != nil {
+			return 0, err
+		}
+
+		kept := make(map[string]bool, len(oldTerms.terms))
+		for _, t := range oldTerms.terms {
+			kept[t] = true
+		}
+		for _, t := range newTerms.terms {
+			if kept[t] {
+				continue
+			}
+			if err = newTerms.field.AppendBytesUintsTx(tx, []byte(t), docId); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	b, err := msgpack.Marshal(&doc)
+	if err != nil {
+		return 0, err
+	}
+	if err = index.documents.SetUIntBytesTx(tx, docId, b); err != nil {
+		return 0, err
+	}
+
+	for _, name := range changed {
+		if name == "full_text" {
+			if err = index.setSimHashTx(tx, docId, &doc); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if err = index.setGroupValuesTx(tx, docId, &doc); err != nil {
+		return 0, err
+	}
+
+	// the pv counter is kept unless the patch replaces it.
+	for i, v := range docValues(&doc) {
+		key := docValueKey(SortFields[i], docId)
+		switch {
+		case SortFields[i] == "pv" && patch.PV == nil:
+		case v == nil:
+			err = index._index.DeleteTx(tx, docValuesIndexName, key)
+		default:
+			err = index._index.SetTx(tx, docValuesIndexName, key, v)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return docId, nil
+}
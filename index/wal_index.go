@@ -0,0 +1,186 @@
+package index
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/mnhkahn/gogogo/logger"
+	"github.com/vmihailenco/msgpack"
+)
+
+// walHeaderSize is the length and the crc32 of a record, both are uint32.
+const walHeaderSize = 8
+
+var errWALCorrupted = errors.New("wal record is corrupted")
+
+// walEntry is a record of the write-ahead log.
+type walEntry struct {
+	Seq uint64    `msgpack:"seq"`
+	Doc *Document `msgpack:"doc"`
+	// size is the length of the record in the file.
+	size int64
+}
+
+// wal is an append only file of documents waiting to be indexed. Each record is
+// | length uint32 | crc32 uint32 | msgpack walEntry |.
+type wal struct {
+	path string
+	file *os.File
+	// size is the length of the file.
+	size int64
+}
+
+// openWAL opens the log at path and reads its records. A broken record at the end,
+// e.g. the process crashed in the middle of a write, is truncated.
+func openWAL(path string) (*wal, []*walEntry, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	entries, offset, err := readWAL(f, info.Size())
+	if err != nil {
+		logger.Warnf("wal %s: %v at %d, truncate the rest.", path, err, offset)
+	}
+	if err = f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return &wal{path: path, file: f, size: offset}, entries, nil
+}
+
+// readWAL returns the valid records of the size bytes of r and the offset following the
+// last one.
+func readWAL(r io.Reader, size int64) ([]*walEntry, int64, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, walHeaderSize)
+
+	var entries []*walEntry
+	var offset int64
+	for {
+		_, err := io.ReadFull(br, header)
+		if err == io.EOF {
+			return entries, offset, nil
+		} else if err != nil {
+			return entries, offset, err
+		}
+
+		// the length of a torn header can be anything, it's checked before allocating.
+		n := int64(binary.BigEndian.Uint32(header[:4]))
+		if n > size-offset-walHeaderSize {
+			return entries, offset, errWALCorrupted
+		}
+		payload := make([]byte, n)
+		if _, err = io.ReadFull(br, payload); err != nil {
+			return entries, offset, err
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			return entries, offset, errWALCorrupted
+		}
+
+		e := &walEntry{size: walHeaderSize + n}
+		if err = msgpack.Unmarshal(payload, e); err != nil {
+			return entries, offset, err
+		}
+		entries = append(entries, e)
+		offset += e.size
+	}
+}
+
+// walRecord encodes e as a record and sets its size.
+func walRecord(e *walEntry) ([]byte, error) {
+	payload, err := msgpack.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[walHeaderSize:], payload)
+	e.size = int64(len(buf))
+	return buf, nil
+}
+
+// append writes e and syncs the file, e is durable when it returns.
+func (w *wal) append(e *walEntry) error {
+	buf, err := walRecord(e)
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.file.Write(buf); err != nil {
+		return err
+	}
+	w.size += e.size
+	return w.file.Sync()
+}
+
+// truncate empties the log once every record is applied.
+func (w *wal) truncate() error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	w.size = 0
+	_, err := w.file.Seek(0, io.SeekStart)
+	return err
+}
+
+// rewrite replaces the log with the records of entries, the records applied before them
+// are dropped. The new log is written aside and renamed over the old one.
+func (w *wal) rewrite(entries []*walEntry) error {
+	tmp := w.path + ".rewrite"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	bw := bufio.NewWriter(f)
+	for _, e := range entries {
+		var buf []byte
+		if buf, err = walRecord(e); err != nil {
+			break
+		}
+		if _, err = bw.Write(buf); err != nil {
+			break
+		}
+		size += e.size
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, w.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	w.file.Close()
+	w.file, w.size = f, size
+	return nil
+}
+
+func (w *wal) close() error {
+	return w.file.Close()
+}
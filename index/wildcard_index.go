@@ -0,0 +1,257 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/mnhkahn/gods/xsort"
+	"github.com/mnhkahn/gogogo/logger"
+	"github.com/willf/bitset"
+)
+
+// MaxExpansions is the largest number of terms a wildcard or a regexp of a query expands to
+// in a field, the others are left out.
+const MaxExpansions = 128
+
+// maxScannedTerms is the largest number of terms read to expand a pattern in a field, a
+// pattern with a short prefix or suffix stops there.
+var maxScannedTerms = 10000
+
+// The buckets of the reversed terms of the keyword fields, | reversed term | => empty, a
+// wildcard with a literal suffix only, e.g. *处理, seeks them by the reversed suffix. They
+// are derived from the terms and rebuilt on open if they are empty.
+var (
+	titleReverseIndexName    = []byte("TitleReverse")
+	briefReverseIndexName    = []byte("BriefReverse")
+	fullTextReverseIndexName = []byte("FullTextReverse")
+
+	reverseIndexNames = [][]byte{titleReverseIndexName, briefReverseIndexName, fullTextReverseIndexName}
+)
+
+// termPattern is a wildcard or a regexp of a query, it matches whole terms.
+type termPattern struct {
+	// expr is the pattern as it's written in the query.
+	expr string
+	re   *regexp.Regexp
+	// prefix is the literal prefix of the terms, suffix the literal suffix of a wildcard
+	// without a prefix.
+	prefix string
+	suffix string
+}
+
+// isRegexpTerm reports whether token of a query is a regexp, e.g. /js(on|ob)/.
+func isRegexpTerm(token string) bool {
+	return len(token) > 2 && token[0] == '/' && token[len(token)-1] == '/'
+}
+
+// isTermPattern reports whether token of a query is a regexp or a wildcard, where * matches
+// any runes and ? a single rune.
+func isTermPattern(token string) bool {
+	return isRegexpTerm(token) || strings.ContainsAny(token, "*?")
+}
+
+// parseTermPattern compiles token of isTermPattern, a wildcard is lowercased like the
+// terms.
+func parseTermPattern(token string) (*termPattern, error) {
+	p := &termPattern{expr: token}
+	expr := ""
+	if isRegexpTerm(token) {
+		expr = token[1 : len(token)-1]
+	} else {
+		wildcard := strings.ToLower(token)
+		for _, r := range wildcard {
+			switch r {
+			case '*':
+				expr += ".*"
+			case '?':
+				expr += "."
+			default:
+				expr += regexp.QuoteMeta(string(r))
+			}
+		}
+		if strings.IndexAny(wildcard, "*?") == 0 {
+			p.suffix = wildcard[strings.LastIndexAny(wildcard, "*?")+1:]
+		}
+	}
+
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, &ParamError{Name: "q", Reason: fmt.Sprintf("regexp %s: %v", token, err)}
+	}
+	p.re = re
+	p.prefix, _ = re.LiteralPrefix()
+	// the terms of a pattern without either are found by reading every term.
+	if p.prefix == "" && p.suffix == "" {
+		return nil, &ParamError{Name: "q", Reason: fmt.Sprintf("%s has no literal prefix or suffix", token)}
+	}
+	return p, nil
+}
+
+// parseQuery splits query into the terms of its text and its term patterns, query is all
+// text unless wildcards is set, see Param.Wildcards.
+func (index *Index) parseQuery(query string, wildcards bool) ([]string, []*termPattern, error) {
+	if !wildcards {
+		return index.segment(query), nil, nil
+	}
+
+	var text []string
+	var patterns []*termPattern
+	for _, token := range strings.Fields(query) {
+		if !isTermPattern(token) {
+			text = append(text, token)
+			continue
+		}
+		p, err := parseTermPattern(token)
+		if err != nil {
+			return nil, nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	return index.segment(strings.Join(text, " ")), patterns, nil
+}
+
+// expandTx returns the terms of ii matching p, at most MaxExpansions of them in order, and
+// whether the expansion stopped there or at maxScannedTerms. The terms are sought by the
+// literal prefix of p, or by its literal suffix in the reversed terms.
+func (p *termPattern) expandTx(tx *bolt.Tx, ii *InvertIndex) ([]string, bool) {
+	var res []string
+	capped, scanned := false, 0
+	// add returns false once the expansions or the scanned terms are full.
+	add := func(term []byte) bool {
+		if scanned++; scanned > maxScannedTerms {
+			capped = true
+			return false
+		}
+		if !p.re.Match(term) {
+			return true
+		}
+		if len(res) == MaxExpansions {
+			capped = true
+			return false
+		}
+		res = append(res, string(term))
+		return true
+	}
+
+	b := tx.Bucket(ii.btname)
+	if p.prefix == "" && ii.reverse != nil {
+		suffix := []byte(reverseTerm(p.suffix))
+		c := tx.Bucket(ii.reverse).Cursor()
+		for k, _ := c.Seek(suffix); k != nil && bytes.HasPrefix(k, suffix); k, _ = c.Next() {
+			term := []byte(reverseTerm(string(k)))
+			if b.Get(term) != nil && !add(term) {
+				break
+			}
+		}
+		sort.Strings(res)
+		return res, capped
+	}
+
+	prefix := []byte(p.prefix)
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if !add(k) {
+			break
+		}
+	}
+	return res, capped
+}
+
+// patternPostings returns the posting list of the terms matching p in every keyword field
+// it matches, the union of the terms is a single term p.expr.
+func (index *Index) patternPostings(p *termPattern, tr *tracer) ([]*termPostings, error) {
+	var res []*termPostings
+	err := index._index.View(func(tx *bolt.Tx) error {
+		for _, f := range index.keywordFields() {
+			terms, capped := p.expandTx(tx, f.ii)
+			if len(terms) == 0 {
+				continue
+			}
+			lists := make([][]uint32, 0, len(terms))
+			for _, term := range terms {
+				docIds, _, err := f.ii.SearchBytesUintsTx(tx, []byte(term))
+				if err != nil {
+					return err
+				}
+				lists = append(lists, docIds)
+			}
+			docIds := xsort.MergeOrUints(lists...)
+
+			detail := f.name + " " + p.expr
+			if capped {
+				detail += fmt.Sprintf(", capped at %d terms or %d scanned", MaxExpansions, maxScannedTerms)
+			}
+			tr.add("expand", detail, terms, len(docIds))
+			res = append(res, &termPostings{field: f.name, terms: []string{p.expr}, docIds: docIds})
+		}
+		return nil
+	})
+	return res, err
+}
+
+// reverseTerm reverses the runes of term.
+func reverseTerm(term string) string {
+	runes := []rune(term)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+// withReverse keeps the reversed terms of t in the bucket name.
+func (t *InvertIndex) withReverse(name []byte) error {
+	if err := t.btree.AddBTree(name); err != nil {
+		return err
+	}
+	t.reverse = name
+	return nil
+}
+
+func (t *InvertIndex) setReverseTx(tx *bolt.Tx, term []byte) error {
+	if t.reverse == nil {
+		return nil
+	}
+	return t.btree.SetTx(tx, t.reverse, []byte(reverseTerm(string(term))), []byte{})
+}
+
+// deleteTermTx deletes the posting list of term and its reversed term.
+func (t *InvertIndex) deleteTermTx(tx *bolt.Tx, term []byte) error {
+	if err := t.btree.DeleteTx(tx, t.btname, term); err != nil {
+		return err
+	}
+	if t.reverse == nil {
+		return nil
+	}
+	return t.btree.DeleteTx(tx, t.reverse, []byte(reverseTerm(string(term))))
+}
+
+// buildReverseTerms writes the reversed terms of every keyword field whose bucket is empty,
+// e.g. the index was created before the reversed terms were.
+func (index *Index) buildReverseTerms() error {
+	var fields []*InvertIndex
+	for _, f := range index.keywordFields() {
+		if index._index.Len(f.ii.reverse) == 0 && f.ii.Len() > 0 {
+			fields = append(fields, f.ii)
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	return index.writer.write(func(tx *bolt.Tx, status *bitset.BitSet) error {
+		for _, ii := range fields {
+			logger.Infof("build reversed terms of %s.", ii.btname)
+			err := tx.Bucket(ii.btname).ForEach(func(k, v []byte) error {
+				return ii.setReverseTx(tx, k)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,144 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/boltdb/bolt"
+	"github.com/willf/bitset"
+)
+
+// writeBatchSize is the max number of queued writes committed in one transaction.
+const writeBatchSize = 256
+
+var ErrIndexClosed = errors.New("index is closed")
+
+// writeOp changes the index in tx, status is the copy of the status bitmap that is
+// swapped in after tx is committed.
+type writeOp func(tx *bolt.Tx, status *bitset.BitSet) error
+
+type writeRequest struct {
+	op   writeOp
+	done chan error
+}
+
+// writer is the single writer of an index. Writes are queued and the worker commits
+// the queued writes together, so concurrent writes never interleave their
+// read-modify-write of the posting lists.
+type writer struct {
+	index *Index
+	queue chan *writeRequest
+
+	lock   sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newWriter(index *Index) *writer {
+	w := new(writer)
+	w.index = index
+	w.queue = make(chan *writeRequest, writeBatchSize)
+	w.wg.Add(1)
+	go w.run()
+	return w
+}
+
+// write queues op and waits until it's committed.
+func (w *writer) write(op writeOp) error {
+	req := &writeRequest{op: op, done: make(chan error, 1)}
+
+	w.lock.RLock()
+	if w.closed {
+		w.lock.RUnlock()
+		return ErrIndexClosed
+	}
+	w.queue <- req
+	w.lock.RUnlock()
+
+	return <-req.done
+}
+
+// close commits the queued writes and stops the worker.
+func (w *writer) close() {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		return
+	}
+	w.closed = true
+	close(w.queue)
+	w.lock.Unlock()
+
+	w.wg.Wait()
+}
+
+func (w *writer) run() {
+	defer w.wg.Done()
+
+	for req := range w.queue {
+		reqs := []*writeRequest{req}
+	batch:
+		for len(reqs) < writeBatchSize {
+			select {
+			case req, ok := <-w.queue:
+				if !ok {
+					break batch
+				}
+				reqs = append(reqs, req)
+			default:
+				break batch
+			}
+		}
+		w.apply(reqs)
+	}
+}
+
+// apply commits reqs in one transaction. If it fails, every request is committed on
+// its own so a bad one doesn't fail the others.
+func (w *writer) apply(reqs []*writeRequest) {
+	err := w.index.commit(func(tx *bolt.Tx, status *bitset.BitSet) error {
+		for _, req := range reqs {
+			if err := req.op(tx, status); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil || len(reqs) == 1 {
+		for _, req := range reqs {
+			req.done <- err
+		}
+		return
+	}
+
+	for _, req := range reqs {
+		req.done <- w.index.commit(req.op)
+	}
+}
+
+// commit runs op and writes the status bitmap in a single transaction, the bitmap in
+// memory is swapped only if the transaction is committed. It must only be called by
+// the writer.
+func (index *Index) commit(op writeOp) (err error) {
+	defer func() {
+		// bolt has rolled back the transaction.
+		if r := recover(); r != nil {
+			err = fmt.Errorf("write panic: %v", r)
+		}
+	}()
+
+	status := index.status.Clone()
+	err = index._index.Update(func(tx *bolt.Tx) error {
+		if err := op(tx, status); err != nil {
+			return err
+		}
+		return index.status.BackupTx(tx, status)
+	})
+	if err != nil {
+		return err
+	}
+
+	index.status.Swap(status)
+	return nil
+}
@@ -2,22 +2,67 @@
 package peanut
 
 import (
-	"net"
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/mnhkahn/gogogo/app"
 	"github.com/mnhkahn/gogogo/logger"
 )
 
+// InitPeanut runs the server with the config of the environment, see Run. An error is
+// logged.
 func InitPeanut() {
-	limit := app.Int("handle_limit")
-	if limit > 0 {
-		app.LimitServe(app.Int("handle_limit"))
-	} else {
-		l, err := net.Listen("tcp", ":"+app.String("port"))
+	if err := Run(nil); err != nil {
+		logger.Errorf("InitPeanut: %v", err)
+	}
+}
+
+// Run loads the config from args (see LoadConfig), starts the server and blocks until it
+// stops serving or gets SIGINT/SIGTERM. Then the requests in flight are drained within the
+// shutdown timeout, and every index flushes its status bitmap and closes.
+func Run(args []string) error {
+	cfg, err := LoadConfig(args)
+	if err != nil {
+		return err
+	}
+
+	s, err := NewServer(cfg)
+	if err != nil {
+		return err
+	}
+
+	err = s.Start()
+	if err != nil {
+		s.Registry().CloseAll()
+		return err
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Wait()
+	}()
+
+	select {
+	case v := <-sig:
+		logger.Info("got signal", v, "shutting down.")
+	case err = <-served:
 		if err != nil {
-			logger.Errorf("Listen: %v", err)
-			return
+			logger.Errorf("Serve: %v", err)
 		}
-		app.Serve(l)
 	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if cfg.ShutdownTimeout.Duration > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+	}
+	defer cancel()
+	if serr := s.Shutdown(ctx); serr != nil && err == nil {
+		err = serr
+	}
+	return err
 }
@@ -0,0 +1,133 @@
+// Package peanut
+package peanut
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/mnhkahn/gogogo/logger"
+	"github.com/mnhkahn/peanut/api"
+	"github.com/mnhkahn/peanut/index"
+	"github.com/mnhkahn/peanut/service"
+)
+
+// Server serves the indexes of a data directory over http.
+type Server struct {
+	cfg      *Config
+	registry *service.Registry
+	server   *http.Server
+
+	lock     sync.Mutex
+	listener net.Listener
+	done     chan error
+}
+
+// NewServer validates cfg and opens the registry of its data directory.
+func NewServer(cfg *Config) (*Server, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	reg, err := service.NewRegistry(cfg.DataPath, index.Options{
+		Dictionary:        cfg.Dictionary,
+		SearchMode:        cfg.SearchMode,
+		MaxPageSize:       cfg.MaxPageSize,
+		RefreshInterval:   cfg.RefreshInterval.Duration,
+		PVFlushInterval:   cfg.PVFlushInterval.Duration,
+		Duplicates:        cfg.Duplicates,
+		DuplicateDistance: cfg.DuplicateDistance,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var h http.Handler = api.NewApi(reg)
+	if cfg.HandleLimit > 0 {
+		h = limitHandler(h, cfg.HandleLimit)
+	}
+
+	s := new(Server)
+	s.cfg = cfg
+	s.registry = reg
+	s.server = &http.Server{
+		Addr:         cfg.Addr,
+		Handler:      h,
+		ReadTimeout:  cfg.ReadTimeout.Duration,
+		WriteTimeout: cfg.WriteTimeout.Duration,
+	}
+	s.done = make(chan error, 1)
+	return s, nil
+}
+
+// Registry returns the registry of the server.
+func (s *Server) Registry() *service.Registry {
+	return s.registry
+}
+
+// Addr returns the listening address, it's nil before Start.
+func (s *Server) Addr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Start listens on the config address and serves in the background.
+func (s *Server) Start() error {
+	l, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.listener = l
+	s.lock.Unlock()
+
+	logger.Infof("Listening and serving HTTP on %s", l.Addr().String())
+	go func() {
+		err := s.server.Serve(l)
+		if err == http.ErrServerClosed {
+			err = nil
+		}
+		s.done <- err
+	}()
+	return nil
+}
+
+// Wait blocks until the server stops serving.
+func (s *Server) Wait() error {
+	return <-s.done
+}
+
+// Shutdown stops accepting requests, waits for the requests in flight until ctx is done,
+// then closes every index.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		logger.Warn("shutdown http server", err)
+	}
+
+	if cerr := s.registry.CloseAll(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// limitHandler handles at most limit requests at the same time, the others wait.
+func limitHandler(h http.Handler, limit int) http.Handler {
+	sem := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case sem <- struct{}{}:
+		case <-r.Context().Done():
+			return
+		}
+		defer func() { <-sem }()
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,140 @@
+// Package service
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mnhkahn/gogogo/logger"
+)
+
+const aliasFileName = "aliases.json"
+
+var (
+	ErrAliasNotFound = errors.New("alias not found")
+	ErrIndexAliased  = errors.New("index is referenced by an alias")
+)
+
+func (r *Registry) aliasPath() string {
+	return filepath.Join(r.dir, aliasFileName)
+}
+
+// loadAliases reads the alias file of the data directory, a missing file means no alias.
+func (r *Registry) loadAliases() error {
+	r.aliases = make(map[string]string)
+
+	byts, err := ioutil.ReadFile(r.aliasPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(byts, &r.aliases)
+}
+
+// saveAliases writes the alias file atomically, it must be called with the write lock held.
+func (r *Registry) saveAliases() error {
+	byts, err := json.MarshalIndent(r.aliases, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := r.aliasPath() + ".tmp"
+	err = ioutil.WriteFile(tmp, byts, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.aliasPath())
+}
+
+// resolve returns the index name an alias points to, or name itself if it's not an alias.
+// It must be called with the lock held.
+func (r *Registry) resolve(name string) string {
+	if target, ok := r.aliases[name]; ok {
+		return target
+	}
+	return name
+}
+
+// Resolve returns the index name an alias points to, or name itself if it's not an alias.
+func (r *Registry) Resolve(name string) string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.resolve(name)
+}
+
+// Aliases returns a copy of all aliases, keyed by alias.
+func (r *Registry) Aliases() map[string]string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	res := make(map[string]string, len(r.aliases))
+	for alias, name := range r.aliases {
+		res[alias] = name
+	}
+	return res
+}
+
+// SetAlias points alias to the index named name. If the alias already exists it's swapped
+// atomically, readers see either the old or the new index.
+func (r *Registry) SetAlias(alias, name string) error {
+	if !ValidName(alias) || !ValidName(name) {
+		return ErrInvalidName
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.indexes[alias]; ok || r.exists(alias) {
+		return ErrIndexExists
+	}
+	if _, ok := r.indexes[name]; !ok && !r.exists(name) {
+		return ErrIndexNotFound
+	}
+
+	old, had := r.aliases[alias]
+	r.aliases[alias] = name
+	if err := r.saveAliases(); err != nil {
+		if had {
+			r.aliases[alias] = old
+		} else {
+			delete(r.aliases, alias)
+		}
+		return err
+	}
+
+	logger.Infof("alias %s: %s -> %s", alias, old, name)
+	return nil
+}
+
+// RemoveAlias removes alias, the index it points to is kept.
+func (r *Registry) RemoveAlias(alias string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	name, ok := r.aliases[alias]
+	if !ok {
+		return ErrAliasNotFound
+	}
+
+	delete(r.aliases, alias)
+	if err := r.saveAliases(); err != nil {
+		r.aliases[alias] = name
+		return err
+	}
+	return nil
+}
+
+// aliased reports whether any alias points to name, it must be called with the lock held.
+func (r *Registry) aliased(name string) bool {
+	for _, target := range r.aliases {
+		if target == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"io"
+
+	"github.com/mnhkahn/gogogo/logger"
+	"github.com/mnhkahn/peanut/index"
+)
+
+// Backup writes a snapshot of the index name to w while it keeps serving, it returns the
+// number of bytes written. name can be an alias.
+func (r *Registry) Backup(name string, w io.Writer) (int64, error) {
+	if _, err := r.Get(name); err != nil {
+		return 0, err
+	}
+
+	// the read lock keeps the index from being closed in the middle of the backup.
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	idx, ok := r.indexes[r.resolve(name)]
+	if !ok {
+		return 0, ErrIndexNotFound
+	}
+	return idx.Backup(w)
+}
+
+// Restore replaces the index name with the snapshot read from rd, the index is created if
+// it doesn't exist. The snapshot is spooled and validated before any lock is taken, so a
+// slow upload doesn't block the other indexes. Then the index is closed, replaced and
+// reopened if it was open. name can be an alias.
+func (r *Registry) Restore(name string, rd io.Reader) error {
+	if !ValidName(name) {
+		return ErrInvalidName
+	}
+
+	s, err := index.ReadSnapshot(r.dir, rd)
+	if err != nil {
+		return err
+	}
+	defer s.Discard()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return ErrRegistryClosed
+	}
+	name = r.resolve(name)
+
+	r.jobLock.Lock()
+	job := r.runningJob(name)
+	r.jobLock.Unlock()
+	if job != nil {
+		return ErrJobRunning
+	}
+
+	idx, open := r.indexes[name]
+	if open {
+		delete(r.indexes, name)
+		if err := idx.Close(); err != nil {
+			logger.Warn("close index", name, err)
+		}
+	}
+
+	logger.Info("restore index", name)
+	err = s.RestoreTo(r.path(name))
+	if open {
+		if _, oerr := r.open(name); err == nil {
+			err = oerr
+		}
+	}
+	return err
+}
+
+// Export writes the live documents of the index name to w as NDJSON while it keeps
+// serving. name can be an alias.
+func (r *Registry) Export(name string, w io.Writer) (int, error) {
+	if _, err := r.Get(name); err != nil {
+		return 0, err
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	idx, ok := r.indexes[r.resolve(name)]
+	if !ok {
+		return 0, ErrIndexNotFound
+	}
+	return idx.Export(w)
+}
+
+// Import adds the NDJSON documents read from rd to the index name in batches, like
+// AddDocuments, the near duplicates rejected are skipped. It returns the number of
+// documents indexed.
+func (r *Registry) Import(name string, rd io.Reader) (int, error) {
+	if _, err := r.Get(name); err != nil {
+		return 0, err
+	}
+	rejected := 0
+	n, err := index.ReadNDJSON(rd, reindexBatch, func(docs []*index.Document) error {
+		err := r.AddDocuments(name, docs...)
+		if e, ok := err.(*index.RejectedError); ok {
+			logger.Warnf("import %s: skip %d near duplicates, %s", name, len(e.Duplicates), e.Duplicates[0])
+			rejected += len(e.Duplicates)
+			return nil
+		}
+		return err
+	})
+	return n - rejected, err
+}
@@ -0,0 +1,256 @@
+// Package service
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mnhkahn/gogogo/logger"
+	"github.com/mnhkahn/peanut/index"
+)
+
+const indexFileExt = ".db"
+
+var (
+	ErrIndexExists    = errors.New("index already exists")
+	ErrIndexNotFound  = errors.New("index not found")
+	ErrInvalidName    = errors.New("invalid index name")
+	ErrRegistryClosed = errors.New("registry is closed")
+
+	indexNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_\-]{0,63}$`)
+)
+
+// IndexInfo describes an index known by the registry.
+type IndexInfo struct {
+	Name string `json:"name"`
+	Path string `json:"path,omitempty"`
+	Open bool   `json:"open"`
+}
+
+// Registry manages named indexes, one bolt file per index under a data directory.
+type Registry struct {
+	dir  string
+	opts index.Options
+
+	lock    sync.RWMutex
+	indexes map[string]*index.Index
+	aliases map[string]string
+	closed  bool
+
+	jobLock sync.Mutex
+	jobs    map[string]*reindexJob
+}
+
+// NewRegistry creates the data directory if needed and returns an empty registry.
+// Indexes are opened with opts lazily by Get or explicitly by Open, aliases are loaded
+// from the alias file of the directory.
+func NewRegistry(dir string, opts index.Options) (*Registry, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("data dir can't be empty")
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(Registry)
+	r.dir = dir
+	r.opts = opts
+	r.indexes = make(map[string]*index.Index)
+	r.jobs = make(map[string]*reindexJob)
+	err = r.loadAliases()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Dir returns the data directory of the registry.
+func (r *Registry) Dir() string {
+	return r.dir
+}
+
+// ValidName reports whether name can be used as an index name.
+func ValidName(name string) bool {
+	return indexNameRegexp.MatchString(name)
+}
+
+func (r *Registry) path(name string) string {
+	return filepath.Join(r.dir, name+indexFileExt)
+}
+
+func (r *Registry) exists(name string) bool {
+	_, err := os.Stat(r.path(name))
+	return err == nil
+}
+
+// Create creates a new index named name and opens it.
+func (r *Registry) Create(name string) (*index.Index, error) {
+	if !ValidName(name) {
+		return nil, ErrInvalidName
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return nil, ErrRegistryClosed
+	}
+	if _, ok := r.indexes[name]; ok || r.exists(name) {
+		return nil, ErrIndexExists
+	}
+	if _, ok := r.aliases[name]; ok {
+		return nil, ErrIndexExists
+	}
+
+	return r.open(name)
+}
+
+// Open opens an existing index, it returns the opened one if it is already open.
+// name can be an alias.
+func (r *Registry) Open(name string) (*index.Index, error) {
+	if !ValidName(name) {
+		return nil, ErrInvalidName
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	name = r.resolve(name)
+	if r.closed {
+		return nil, ErrRegistryClosed
+	}
+	if idx, ok := r.indexes[name]; ok {
+		return idx, nil
+	}
+	if !r.exists(name) {
+		return nil, ErrIndexNotFound
+	}
+
+	return r.open(name)
+}
+
+// open must be called with the write lock held.
+func (r *Registry) open(name string) (*index.Index, error) {
+	idx, err := index.NewIndexWithOptions(r.path(name), r.opts)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("open index", name)
+	r.indexes[name] = idx
+	return idx, nil
+}
+
+// Get returns the index named name, opening it if it exists on disk. name can be an alias.
+func (r *Registry) Get(name string) (*index.Index, error) {
+	r.lock.RLock()
+	idx, ok := r.indexes[r.resolve(name)]
+	r.lock.RUnlock()
+	if ok {
+		return idx, nil
+	}
+
+	return r.Open(name)
+}
+
+// List returns every index in the data directory, sorted by name.
+func (r *Registry) List() ([]*IndexInfo, error) {
+	files, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	res := make([]*IndexInfo, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), indexFileExt) {
+			continue
+		}
+		name := strings.TrimSuffix(f.Name(), indexFileExt)
+		if !ValidName(name) {
+			continue
+		}
+		_, open := r.indexes[name]
+		res = append(res, &IndexInfo{Name: name, Path: r.path(name), Open: open})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+
+	return res, nil
+}
+
+// Close closes the index named name, its file is kept. name can be an alias.
+func (r *Registry) Close(name string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	name = r.resolve(name)
+	idx, ok := r.indexes[name]
+	if !ok {
+		if r.exists(name) {
+			return nil
+		}
+		return ErrIndexNotFound
+	}
+	delete(r.indexes, name)
+	logger.Info("close index", name)
+	return idx.Close()
+}
+
+// Drop closes the index named name and removes its file.
+// An index that is still referenced by an alias can't be dropped.
+func (r *Registry) Drop(name string) error {
+	if !ValidName(name) {
+		return ErrInvalidName
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.aliased(name) {
+		return ErrIndexAliased
+	}
+
+	if idx, ok := r.indexes[name]; ok {
+		delete(r.indexes, name)
+		if err := idx.Close(); err != nil {
+			logger.Warn("close index", name, err)
+		}
+	} else if !r.exists(name) {
+		return ErrIndexNotFound
+	}
+
+	logger.Info("drop index", name)
+	if err := os.Remove(r.path(name) + ".wal"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(r.path(name))
+}
+
+// CloseAll closes every open index, the registry can't be used afterwards.
+func (r *Registry) CloseAll() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var firstErr error
+	for name, idx := range r.indexes {
+		if err := idx.Close(); err != nil {
+			logger.Warn("close index", name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		delete(r.indexes, name)
+	}
+	r.closed = true
+
+	return firstErr
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"blog":                  true,
+		"blog-2018_v1":          true,
+		"0":                     true,
+		"":                      false,
+		"Blog":                  false,
+		"-blog":                 false,
+		"blog.db":               false,
+		"../blog":               false,
+		"blog/posts":            false,
+		strings.Repeat("a", 64): true,
+		strings.Repeat("a", 65): false,
+	} {
+		assert.Equal(t, valid, ValidName(name), name)
+	}
+}
+
+func TestRegistryCreateDrop(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	_, err := r.Create("blog")
+	assert.Nil(t, err)
+	_, err = r.Create("blog")
+	assert.Equal(t, ErrIndexExists, err)
+	_, err = r.Create("../blog")
+	assert.Equal(t, ErrInvalidName, err)
+	_, err = r.Get("news")
+	assert.Equal(t, ErrIndexNotFound, err)
+
+	// a closed index is listed and opened again by Get.
+	assert.Nil(t, r.Close("blog"))
+	infos, err := r.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []*IndexInfo{{Name: "blog", Path: r.path("blog"), Open: false}}, infos)
+	_, err = r.Get("blog")
+	assert.Nil(t, err)
+
+	assert.Nil(t, r.Drop("blog"))
+	assert.Equal(t, ErrIndexNotFound, r.Drop("blog"))
+	assert.False(t, r.exists("blog"))
+	infos, err = r.List()
+	assert.Nil(t, err)
+	assert.Empty(t, infos)
+}
+
+func TestRegistryAliases(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	blog, err := r.Create("blog")
+	assert.Nil(t, err)
+	_, err = r.Create("blog-v2")
+	assert.Nil(t, err)
+
+	assert.Equal(t, ErrIndexNotFound, r.SetAlias("posts", "news"))
+	assert.Equal(t, ErrIndexExists, r.SetAlias("blog-v2", "blog"))
+	assert.Equal(t, ErrInvalidName, r.SetAlias("Posts", "blog"))
+	assert.Nil(t, r.SetAlias("posts", "blog"))
+
+	assert.Equal(t, "blog", r.Resolve("posts"))
+	assert.Equal(t, "news", r.Resolve("news"))
+	idx, err := r.Get("posts")
+	assert.Nil(t, err)
+	assert.True(t, idx == blog)
+	_, err = r.Create("posts")
+	assert.Equal(t, ErrIndexExists, err)
+	assert.Equal(t, ErrIndexAliased, r.Drop("blog"))
+
+	// the aliases are kept in the data dir.
+	other, err := NewRegistry(r.Dir(), r.opts)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"posts": "blog"}, other.Aliases())
+
+	// an alias is swapped to another index.
+	assert.Nil(t, r.SetAlias("posts", "blog-v2"))
+	assert.Equal(t, "blog-v2", r.Resolve("posts"))
+	assert.Nil(t, r.Drop("blog"))
+
+	assert.Nil(t, r.RemoveAlias("posts"))
+	assert.Equal(t, ErrAliasNotFound, r.RemoveAlias("posts"))
+	assert.Equal(t, "posts", r.Resolve("posts"))
+	assert.Nil(t, r.Drop("blog-v2"))
+}
@@ -0,0 +1,484 @@
+// Package service
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mnhkahn/gogogo/logger"
+	"github.com/mnhkahn/peanut/index"
+)
+
+const (
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// reindexBatch is the number of documents read from the source index at a time.
+const reindexBatch = 100
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	ErrJobRunning  = errors.New("a reindex job is already running for this index")
+)
+
+// JobStatus is the progress of a reindex job. Rejected counts the documents the new index
+// rejected as near duplicates, they are skipped.
+type JobStatus struct {
+	ID         string    `json:"id"`
+	Source     string    `json:"source"`
+	Target     string    `json:"target"`
+	Alias      string    `json:"alias,omitempty"`
+	State      string    `json:"state"`
+	Total      int       `json:"total"`
+	Done       int       `json:"done"`
+	Rejected   int       `json:"rejected"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+type reindexJob struct {
+	lock   sync.Mutex
+	status JobStatus
+	target *index.Index
+	// written holds the pks mirrored to target while copying, the copy must not
+	// overwrite them with the older version read from the source.
+	written map[string]bool
+}
+
+func (j *reindexJob) Status() *JobStatus {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	s := j.status
+	return &s
+}
+
+func (j *reindexJob) running() bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.status.State == JobRunning
+}
+
+func (j *reindexJob) finish(err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.status.State = JobDone
+	if err != nil {
+		j.status.State = JobFailed
+		j.status.Error = err.Error()
+	}
+	j.status.FinishedAt = time.Now()
+	logger.Infof("reindex job %s %s: %s -> %s, %d/%d, %d rejected.", j.status.ID, j.status.State, j.status.Source, j.status.Target, j.status.Done, j.status.Total, j.status.Rejected)
+}
+
+// Reindex rebuilds the index name (an alias or an index) into a new bolt file from its
+// stored documents in the background, so a new analyzer or dictionary is applied.
+// If name is an alias, it's swapped to the new index once the job is done; the old index
+// is kept and can be dropped afterwards.
+// Documents written through AddDocuments while the job runs are mirrored to the new index.
+func (r *Registry) Reindex(name string) (*JobStatus, error) {
+	job, src, err := r.startReindex(name)
+	if err != nil {
+		return nil, err
+	}
+	go r.runReindex(job, src)
+	return job.Status(), nil
+}
+
+// startReindex creates the new index of name and registers the running job, runReindex
+// copies the documents of src.
+func (r *Registry) startReindex(name string) (*reindexJob, *index.Index, error) {
+	source := r.Resolve(name)
+	alias := ""
+	if source != name {
+		alias = name
+	}
+
+	src, err := r.Get(source)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the registry lock is always taken before the job lock, so create the target first.
+	now := time.Now()
+	target := reindexTargetName(name, now)
+	dst, err := r.Create(target)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r.jobLock.Lock()
+	if r.runningJob(source) != nil {
+		// Drop takes the registry lock, it can't be called under the job lock.
+		r.jobLock.Unlock()
+		if err = r.Drop(target); err != nil {
+			logger.Warnf("reindex %s: drop %s: %v", source, target, err)
+		}
+		return nil, nil, ErrJobRunning
+	}
+	defer r.jobLock.Unlock()
+
+	job := new(reindexJob)
+	job.status = JobStatus{
+		ID:        fmt.Sprintf("reindex-%d", now.UnixNano()),
+		Source:    source,
+		Target:    target,
+		Alias:     alias,
+		State:     JobRunning,
+		StartedAt: now,
+	}
+	job.target = dst
+	job.written = make(map[string]bool)
+	r.jobs[job.status.ID] = job
+
+	logger.Infof("reindex job %s started: %s -> %s.", job.status.ID, source, target)
+	return job, src, nil
+}
+
+func reindexTargetName(name string, t time.Time) string {
+	suffix := "-" + t.Format("20060102150405")
+	if len(name)+len(suffix) > 64 {
+		name = name[:64-len(suffix)]
+	}
+	return name + suffix
+}
+
+func (r *Registry) runReindex(job *reindexJob, src *index.Index) {
+	job.lock.Lock()
+	job.status.Total = src.Count()
+	job.lock.Unlock()
+
+	// the docIds are read a batch at a time, the documents added meanwhile are mirrored.
+	var err error
+	for docIds := src.LiveDocIds(0, reindexBatch); len(docIds) > 0; docIds = src.LiveDocIds(docIds[len(docIds)-1]+1, reindexBatch) {
+		if err = job.copy(src.ToDocuments(docIds...)); err != nil {
+			job.finish(err)
+			return
+		}
+	}
+
+	if job.status.Alias != "" {
+		// SetAlias waits for the writes in flight, the later writes go to the new index.
+		if err = r.SetAlias(job.status.Alias, job.status.Target); err != nil {
+			job.finish(err)
+			return
+		}
+	}
+	job.finish(nil)
+}
+
+// copy adds docs to the new index in a batch, the near duplicates it rejects are skipped
+// and counted.
+func (j *reindexJob) copy(docs []*index.Document) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.status.Done += len(docs)
+	batch := make([]*index.Document, 0, len(docs))
+	for _, doc := range docs {
+		if doc.PK != "" && !j.written[doc.PK] {
+			batch = append(batch, doc)
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	err := j.target.AddDocuments(batch...)
+	if rejected, ok := err.(*index.RejectedError); ok {
+		j.status.Rejected += len(rejected.Duplicates)
+		return nil
+	}
+	return err
+}
+
+// mirrorDelete removes pk from the new index, the copy skips it afterwards.
+func (j *reindexJob) mirrorDelete(pk string) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.status.State != JobRunning {
+		return nil
+	}
+	j.written[pk] = true
+	if err := j.target.DeleteDocument(pk); err != nil && err != index.ErrDocumentNotFound {
+		return err
+	}
+	return nil
+}
+
+// mirrorUpdate patches pk in the new index if it's copied already, else doc, the patched
+// document of the source, is copied and the copy skips pk afterwards: the copy may hold
+// the document read before the patch.
+func (j *reindexJob) mirrorUpdate(pk string, patch *index.DocumentPatch, doc *index.Document) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.status.State != JobRunning {
+		return nil
+	}
+	_, err := j.target.UpdateDocument(pk, patch)
+	if err != index.ErrDocumentNotFound {
+		return err
+	}
+	j.written[pk] = true
+	err = j.target.AddDocuments(doc)
+	if _, ok := err.(*index.RejectedError); ok {
+		return nil
+	}
+	return err
+}
+
+// mirrorIncrPVs counts the views of the documents already copied to the new index. The
+// others are copied from src now with their pv and the copy skips them afterwards: the
+// copy may hold the pv read before the views.
+func (j *reindexJob) mirrorIncrPVs(src *index.Index, deltas map[string]int) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.status.State != JobRunning {
+		return nil
+	}
+	pvs, err := j.target.IncrPVs(deltas)
+	if err != nil {
+		return err
+	}
+
+	var pks []string
+	for pk := range deltas {
+		// a pk written and missing is deleted.
+		if _, ok := pvs[pk]; !ok && !j.written[pk] {
+			pks = append(pks, pk)
+		}
+	}
+	if len(pks) == 0 {
+		return nil
+	}
+	docIds, err := src.SearchPks(pks...)
+	if err != nil || len(docIds) == 0 {
+		return err
+	}
+	docs := src.ToDocuments(docIds...)
+	for _, doc := range docs {
+		j.written[doc.PK] = true
+	}
+	err = j.target.AddDocuments(docs...)
+	if _, ok := err.(*index.RejectedError); ok {
+		return nil
+	}
+	return err
+}
+
+func (j *reindexJob) mirror(docs []*index.Document) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.status.State != JobRunning {
+		return nil
+	}
+	for _, doc := range docs {
+		j.written[doc.PK] = true
+	}
+	// the new index rejects the near duplicates the source rejected.
+	err := j.target.AddDocuments(docs...)
+	if _, ok := err.(*index.RejectedError); ok {
+		return nil
+	}
+	return err
+}
+
+// runningJob must be called with the job lock held.
+func (r *Registry) runningJob(source string) *reindexJob {
+	for _, job := range r.jobs {
+		if job.status.Source == source && job.running() {
+			return job
+		}
+	}
+	return nil
+}
+
+// Job returns the status of the job id.
+func (r *Registry) Job(id string) (*JobStatus, error) {
+	r.jobLock.Lock()
+	defer r.jobLock.Unlock()
+
+	job, ok := r.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return job.Status(), nil
+}
+
+// Jobs returns the status of all jobs, the latest first.
+func (r *Registry) Jobs() []*JobStatus {
+	r.jobLock.Lock()
+	defer r.jobLock.Unlock()
+
+	res := make([]*JobStatus, 0, len(r.jobs))
+	for _, job := range r.jobs {
+		res = append(res, job.Status())
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].StartedAt.After(res[j].StartedAt) })
+	return res
+}
+
+// AddDocuments adds docs to the index name (an alias or an index), see
+// index.AddDocuments. While a reindex job of this index is running, docs are written to
+// the new index too.
+func (r *Registry) AddDocuments(name string, docs ...*index.Document) error {
+	return r.writeDocuments(name, docs, func(idx *index.Index, docs []*index.Document) error {
+		return idx.AddDocuments(docs...)
+	})
+}
+
+// EnqueueDocuments queues docs to the index name, they become searchable after its next
+// refresh. While a reindex job of this index is running, docs are written to the new
+// index at once.
+func (r *Registry) EnqueueDocuments(name string, docs ...*index.Document) error {
+	return r.writeDocuments(name, docs, func(idx *index.Index, docs []*index.Document) error {
+		for _, doc := range docs {
+			if _, err := idx.Enqueue(doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteDocument removes the document pk from the index name. While a reindex job of this
+// index is running, it's removed from the new index too.
+func (r *Registry) DeleteDocument(name, pk string) error {
+	if _, err := r.Get(name); err != nil {
+		return err
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	source := r.resolve(name)
+	idx, ok := r.indexes[source]
+	if !ok {
+		return ErrIndexNotFound
+	}
+	if err := idx.DeleteDocument(pk); err != nil {
+		return err
+	}
+
+	r.jobLock.Lock()
+	job := r.runningJob(source)
+	r.jobLock.Unlock()
+	if job != nil {
+		return job.mirrorDelete(pk)
+	}
+	return nil
+}
+
+// UpdateDocument merges patch into the document pk of the index name, see
+// index.UpdateDocument. While a reindex job of this index is running, it's patched in the
+// new index too.
+func (r *Registry) UpdateDocument(name, pk string, patch *index.DocumentPatch) (*index.Document, error) {
+	if _, err := r.Get(name); err != nil {
+		return nil, err
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	source := r.resolve(name)
+	idx, ok := r.indexes[source]
+	if !ok {
+		return nil, ErrIndexNotFound
+	}
+	doc, err := idx.UpdateDocument(pk, patch)
+	if err != nil {
+		return nil, err
+	}
+
+	r.jobLock.Lock()
+	job := r.runningJob(source)
+	r.jobLock.Unlock()
+	if job != nil {
+		return doc, job.mirrorUpdate(pk, patch, doc)
+	}
+	return doc, nil
+}
+
+// IncrPVs adds the deltas to the pv of the documents of the index name by pk, see
+// index.IncrPVs. While a reindex job of this index is running, they're counted in the
+// new index too.
+func (r *Registry) IncrPVs(name string, deltas map[string]int) (map[string]int, error) {
+	if _, err := r.Get(name); err != nil {
+		return nil, err
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	source := r.resolve(name)
+	idx, ok := r.indexes[source]
+	if !ok {
+		return nil, ErrIndexNotFound
+	}
+	pvs, err := idx.IncrPVs(deltas)
+	if err != nil {
+		return nil, err
+	}
+
+	r.jobLock.Lock()
+	job := r.runningJob(source)
+	r.jobLock.Unlock()
+	if job != nil {
+		return pvs, job.mirrorIncrPVs(idx, deltas)
+	}
+	return pvs, nil
+}
+
+// Refresh waits until the documents queued to the index name are searchable.
+func (r *Registry) Refresh(name string) error {
+	idx, err := r.Get(name)
+	if err != nil {
+		return err
+	}
+	return idx.Refresh()
+}
+
+func (r *Registry) writeDocuments(name string, docs []*index.Document, write func(*index.Index, []*index.Document) error) error {
+	// make sure the index is open before holding the read lock.
+	if _, err := r.Get(name); err != nil {
+		return err
+	}
+
+	// the read lock keeps the alias from being swapped in the middle of the write.
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	source := r.resolve(name)
+	idx, ok := r.indexes[source]
+	if !ok {
+		return ErrIndexNotFound
+	}
+
+	// the near duplicates rejected are reported once the others are mirrored.
+	err := write(idx, docs)
+	if _, ok := err.(*index.RejectedError); !ok && err != nil {
+		return err
+	}
+
+	r.jobLock.Lock()
+	job := r.runningJob(source)
+	r.jobLock.Unlock()
+	if job != nil {
+		if merr := job.mirror(docs); merr != nil {
+			return merr
+		}
+	}
+	return err
+}
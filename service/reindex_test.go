@@ -0,0 +1,136 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mnhkahn/peanut/index"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestRegistry returns a registry in a new temp dir, cleanup closes it and removes the
+// dir.
+func newTestRegistry(t *testing.T) (*Registry, func()) {
+	dir, err := ioutil.TempDir("", "peanut-service")
+	assert.Nil(t, err)
+
+	opts := index.DefaultOptions
+	opts.Dictionary = "../index/dictionary.txt"
+	r, err := NewRegistry(dir, opts)
+	assert.Nil(t, err)
+	return r, func() {
+		r.CloseAll()
+		os.RemoveAll(dir)
+	}
+}
+
+// readDocuments returns the documents of pks in idx, as the copy of a reindex job reads
+// them.
+func readDocuments(t *testing.T, idx *index.Index, pks ...string) []*index.Document {
+	docIds, err := idx.SearchPks(pks...)
+	assert.Nil(t, err)
+	return idx.ToDocuments(docIds...)
+}
+
+func TestReindexMirrorUpdate(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	src, err := r.Create("blog")
+	assert.Nil(t, err)
+	assert.Nil(t, src.AddDocuments(&index.Document{PK: "a", Title: "golang"}, &index.Document{PK: "b", Title: "json"}))
+
+	job, src, err := r.startReindex("blog")
+	assert.Nil(t, err)
+
+	// the copy reads a, a is patched, then the copy writes what it read.
+	docs := readDocuments(t, src, "a")
+	title := "golang json"
+	_, err = r.UpdateDocument("blog", "a", &index.DocumentPatch{Title: &title})
+	assert.Nil(t, err)
+	assert.Nil(t, job.copy(docs))
+
+	// b is copied before it's patched.
+	assert.Nil(t, job.copy(readDocuments(t, src, "b")))
+	brief := "encoding"
+	_, err = r.UpdateDocument("blog", "b", &index.DocumentPatch{Brief: &brief})
+	assert.Nil(t, err)
+
+	res := readDocuments(t, job.target, "a", "b")
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, "golang json", res[0].Title)
+	assert.Equal(t, "encoding", res[1].Brief)
+}
+
+func TestReindexMirrorIncrPVs(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	src, err := r.Create("blog")
+	assert.Nil(t, err)
+	assert.Nil(t, src.AddDocuments(&index.Document{PK: "a", Title: "golang", PV: 1}, &index.Document{PK: "b", Title: "json", PV: 1}))
+
+	job, src, err := r.startReindex("blog")
+	assert.Nil(t, err)
+
+	// the copy reads a, a is viewed, then the copy writes what it read.
+	docs := readDocuments(t, src, "a")
+	_, err = r.IncrPVs("blog", map[string]int{"a": 2, "c": 1})
+	assert.Nil(t, err)
+	assert.Nil(t, job.copy(docs))
+
+	// b is copied before it's viewed.
+	assert.Nil(t, job.copy(readDocuments(t, src, "b")))
+	_, err = r.IncrPVs("blog", map[string]int{"b": 3})
+	assert.Nil(t, err)
+
+	res := readDocuments(t, job.target, "a", "b", "c")
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, 3, res[0].PV)
+	assert.Equal(t, 4, res[1].PV)
+}
+
+func TestReindex(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	src, err := r.Create("blog-v1")
+	assert.Nil(t, err)
+	docs := make([]*index.Document, 0, 2*reindexBatch+10)
+	for i := 0; i < cap(docs); i++ {
+		docs = append(docs, &index.Document{PK: fmt.Sprint(i), Title: "golang", PV: i})
+	}
+	assert.Nil(t, src.AddDocuments(docs...))
+	assert.Nil(t, src.DeleteDocument("0"))
+	assert.Nil(t, r.SetAlias("blog", "blog-v1"))
+
+	job, src, err := r.startReindex("blog")
+	assert.Nil(t, err)
+
+	// a second job of the index is refused, its new index is dropped at once.
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	_, err = r.Reindex("blog")
+	assert.Equal(t, ErrJobRunning, err)
+	infos, err := r.List()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(infos))
+
+	r.runReindex(job, src)
+	status := job.Status()
+	assert.Equal(t, JobDone, status.State)
+	assert.Equal(t, len(docs)-1, status.Total)
+	assert.Equal(t, len(docs)-1, status.Done)
+	assert.Equal(t, status.Target, r.Resolve("blog"))
+
+	dst, err := r.Get("blog")
+	assert.Nil(t, err)
+	assert.Equal(t, len(docs)-1, dst.Count())
+	res := readDocuments(t, dst, "0", "1", fmt.Sprint(len(docs)-1))
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, len(docs)-1, res[1].PV)
+	// the old index is kept.
+	assert.Nil(t, r.Drop("blog-v1"))
+}